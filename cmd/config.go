@@ -92,7 +92,7 @@ type RelaySetting map[string]*AppSection
 type AppSection struct {
 	Host    string
 	Ports   []uint16
-	OutPort uint16 `toml:outport`
+	OutPort uint16
 	Prog    string
 	Args    string
 	Curr    int
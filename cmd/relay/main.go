@@ -22,6 +22,7 @@ var (
 	relayServer   bool
 	relay, server bool
 	verbose       bool
+	record        string // 录制会话的目录
 )
 
 // 解析参数
@@ -42,6 +43,7 @@ func init() {
 	flag.BoolVar(&server, "s", false, "只运行后端server")
 	flag.BoolVar(&relayServer, "rs", false, "relay和server都运行")
 
+	flag.StringVar(&record, "rec", "", "录制转发的会话到这个目录")
 	flag.BoolVar(&verbose, "v", false, "输出详细信息")
 	flag.Parse()
 }
@@ -85,13 +87,26 @@ func run() {
 		}
 		return
 	}
-	// 运行端口转发的relay
+	// 运行端口转发的relay，收到SIGUSR2时平滑升级，新进程接管转发的端口，不用停止监听
 	if relayServer || relay {
 		addr := network.NewTCPAddr(app.Host, inPort)
 		relayer := unix.NewRelayer(addr)
 		proxy := unix.NewProxy("tcp", "", app.OutPort)
 		events := network.Events{}
-		events.Process = proxy.CreateProcess(relayer, unix.RelayData)
+		action := unix.RelayData
+		if record != "" {
+			recorder := unix.NewRecorder(record)
+			recorder.Failed = func(s *network.Server, c *network.Conn, err error) {
+				fmt.Println("record error: ", err)
+			}
+			action = recorder.Relay
+		}
+		events.Process = proxy.CreateProcess(relayer, action)
+		upgrader := network.DefaultUpgrader
+		upgrader.Failed = func(err error) {
+			fmt.Println("upgrade error: ", err)
+		}
+		upgrader.WatchSignal()
 		proxy.Run(events)
 	}
 }
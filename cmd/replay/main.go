@@ -0,0 +1,82 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/azhai/gozzo-net/unix"
+)
+
+var (
+	filename string // 录制文件路径
+	address  string // 后端地址，或者等待客户端的监听地址
+	backend  bool
+	fast     bool
+	wait     time.Duration // 发完后等待对方关闭的时间
+	verbose  bool
+)
+
+// 解析参数
+func init() {
+	flag.StringVar(&filename, "f", "", "录制文件路径")
+	flag.StringVar(&address, "addr", "", "后端地址，默认为录制时的后端；回放后端时为监听地址")
+	flag.BoolVar(&backend, "b", false, "回放后端，等待一个客户端连接")
+	flag.BoolVar(&fast, "fast", false, "尽快发送，不按录制时的时间间隔")
+	flag.DurationVar(&wait, "wait", 10*time.Second, "发完后等待对方关闭的最长时间，为0时一直等")
+	flag.BoolVar(&verbose, "v", false, "输出对方的回应")
+	flag.Parse()
+}
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// 回放客户端时连接后端，回放后端时等待客户端
+func run() error {
+	cr, err := unix.OpenCapture(filename)
+	if err != nil {
+		return err
+	}
+	defer cr.Close()
+	opts := unix.ReplayOptions{Dir: unix.CaptureUpstream, Realtime: !fast, Wait: wait}
+	if verbose {
+		opts.Output = os.Stdout
+	}
+	var conn net.Conn
+	if backend {
+		opts.Dir = unix.CaptureDownstream
+		conn, err = accept(address)
+	} else {
+		if address == "" {
+			address = cr.Backend
+		}
+		conn, err = net.Dial("tcp", address)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	sent, err := unix.Replay(cr, conn, opts)
+	if verbose {
+		fmt.Fprintf(os.Stderr, "\nsent %d bytes to %s\n", sent, conn.RemoteAddr())
+	}
+	return err
+}
+
+func accept(address string) (net.Conn, error) {
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	defer ln.Close()
+	if verbose {
+		fmt.Fprintf(os.Stderr, "waiting for a client on %s\n", ln.Addr())
+	}
+	return ln.Accept()
+}
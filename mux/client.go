@@ -0,0 +1,128 @@
+package mux
+
+import (
+	"sync"
+
+	"github.com/azhai/gozzo-net/network"
+	"github.com/azhai/gozzo-net/tcp"
+)
+
+// 作为TCP服务的Process，每个连接是一个会话，会话中的每个流交给events处理
+func Serve(events network.Events, conf Config) network.ProcessFunc {
+	return func(s *network.Server, c *network.Conn) {
+		session := NewServerSession(c, conf)
+		defer session.Close()
+		for {
+			stream, err := session.Accept()
+			if err != nil {
+				return
+			}
+			go s.Execute(events, stream.Conn())
+		}
+	}
+}
+
+// 共用一个TCP连接的拨号器，连接断开后下一次打开流时重新拨号
+type Dialer struct {
+	Config  Config
+	client  *tcp.TCPClient
+	session *Session
+	mutex   sync.Mutex
+}
+
+func NewDialer(plan *network.DialPlan, opts network.TCPOptions) *Dialer {
+	return &Dialer{Config: DefaultConfig, client: tcp.NewClient(plan, opts)}
+}
+
+func (d *Dialer) GetPlan() *network.DialPlan {
+	return d.client.GetPlan()
+}
+
+// 当前的会话，没有或者已经断开时重新拨号
+func (d *Dialer) Session() (*Session, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.session != nil && !d.session.IsClosed() {
+		return d.session, nil
+	}
+	conn, err := d.client.Dialing()
+	if err != nil {
+		if conn != nil {
+			conn.Close()
+		}
+		return nil, err
+	}
+	d.client.SetConn(conn)
+	d.session = NewClientSession(conn, d.Config)
+	return d.session, nil
+}
+
+// 打开一个流，对方GoAway之后换一个新的连接
+func (d *Dialer) Open() (*network.Conn, error) {
+	session, err := d.Session()
+	if err != nil {
+		return nil, err
+	}
+	stream, err := session.Open()
+	if err == ErrRemoteGoAway || err == ErrSessionShutdown {
+		d.mutex.Lock()
+		if d.session == session {
+			d.session = nil
+		}
+		d.mutex.Unlock()
+		go session.Shutdown(session.config.StreamCloseTimeout) // 等已有的流结束
+		if session, err = d.Session(); err != nil {
+			return nil, err
+		}
+		stream, err = session.Open()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return stream.Conn(), nil
+}
+
+// 关闭会话和所有的流
+func (d *Dialer) Close() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.session != nil {
+		d.session.Close()
+		d.session = nil
+	}
+	return nil
+}
+
+// 创建一个客户端，Dialing时打开新的流而不是新的TCP连接
+func (d *Dialer) NewClient() *Client {
+	return &Client{dialer: d}
+}
+
+// 多路复用的客户端，实现了network.IClient，用法与tcp.TCPClient相同
+type Client struct {
+	dialer *Dialer
+	Conn   *network.Conn
+}
+
+func (c *Client) Close() error {
+	if c.Conn == nil {
+		return nil
+	}
+	return c.Conn.Close()
+}
+
+func (c *Client) GetPlan() *network.DialPlan {
+	return c.dialer.GetPlan()
+}
+
+func (c *Client) GetConn() *network.Conn {
+	return c.Conn
+}
+
+func (c *Client) SetConn(conn *network.Conn) {
+	c.Conn = conn
+}
+
+func (c *Client) Dialing() (*network.Conn, error) {
+	return c.dialer.Open()
+}
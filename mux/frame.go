@@ -0,0 +1,99 @@
+package mux
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// 帧头：版本(1) 类型(1) 标志(2) 流ID(4) 长度(4)，都是大端
+// Data帧的长度是后面数据的字节数，WindowUpdate帧是窗口的增量
+// Ping帧的长度是不透明的序号，GoAway帧是原因
+const (
+	protoVersion = 0
+	headerSize   = 12
+)
+
+// 帧类型
+const (
+	typeData         uint8 = 0
+	typeWindowUpdate uint8 = 1
+	typePing         uint8 = 2
+	typeGoAway       uint8 = 3
+)
+
+// 帧标志
+const (
+	flagSYN uint16 = 1 << 0 // 打开流
+	flagACK uint16 = 1 << 1 // 确认流的打开，或者Ping的回应
+	flagFIN uint16 = 1 << 2 // 半关闭，不再发送数据
+	flagRST uint16 = 1 << 3 // 重置流
+)
+
+// GoAway的原因
+const (
+	goAwayNormal        uint32 = 0
+	goAwayProtocolError uint32 = 1
+	goAwayInternalError uint32 = 2
+)
+
+// 单个Data帧最多携带的字节数
+const maxFrameData = 32 * 1024
+
+var (
+	ErrSessionShutdown  = fmt.Errorf("Session shutdown")
+	ErrStreamClosed     = fmt.Errorf("Stream closed")
+	ErrStreamReset      = fmt.Errorf("Stream reset by peer")
+	ErrRemoteGoAway     = fmt.Errorf("Remote end is not accepting streams")
+	ErrStreamsExhausted = fmt.Errorf("Stream IDs exhausted")
+	ErrProtocol         = fmt.Errorf("Mux protocol error")
+	ErrKeepAliveTimeout = fmt.Errorf("Keepalive timeout")
+	ErrNotSupported     = fmt.Errorf("Not supported by mux streams")
+	ErrTimeout          = timeoutError{}
+)
+
+// 超时错误，实现了net.Error
+type timeoutError struct{}
+
+func (e timeoutError) Error() string   { return "i/o timeout" }
+func (e timeoutError) Timeout() bool   { return true }
+func (e timeoutError) Temporary() bool { return true }
+
+type header [headerSize]byte
+
+func newHeader(typ uint8, flags uint16, id uint32, length uint32) (h header) {
+	h[0] = protoVersion
+	h[1] = typ
+	binary.BigEndian.PutUint16(h[2:4], flags)
+	binary.BigEndian.PutUint32(h[4:8], id)
+	binary.BigEndian.PutUint32(h[8:12], length)
+	return
+}
+
+func (h header) Version() uint8   { return h[0] }
+func (h header) Type() uint8      { return h[1] }
+func (h header) Flags() uint16    { return binary.BigEndian.Uint16(h[2:4]) }
+func (h header) StreamID() uint32 { return binary.BigEndian.Uint32(h[4:8]) }
+func (h header) Length() uint32   { return binary.BigEndian.Uint32(h[8:12]) }
+
+// 多路复用的参数
+// AcceptBacklog: 等待Accept的流的个数上限，超过时新的流被重置
+// Window: 每个流的接收窗口，对方最多可以先发送这么多字节
+// KeepAliveInterval: 发送Ping的间隔，为0时不发送
+// WriteTimeout: 写帧和等待Ping回应的超时，为0时不限制，保活时最多等待一个间隔
+// StreamCloseTimeout: 关闭流后等待对方关闭的时间，超时后重置
+type Config struct {
+	AcceptBacklog      int
+	Window             uint32
+	KeepAliveInterval  time.Duration
+	WriteTimeout       time.Duration
+	StreamCloseTimeout time.Duration
+}
+
+var DefaultConfig = Config{
+	AcceptBacklog:      256,
+	Window:             256 * 1024,
+	KeepAliveInterval:  30 * time.Second,
+	WriteTimeout:       10 * time.Second,
+	StreamCloseTimeout: 30 * time.Second,
+}
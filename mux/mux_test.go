@@ -0,0 +1,312 @@
+package mux
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/azhai/gozzo-net/network"
+	"github.com/azhai/gozzo-net/tcp"
+)
+
+// 两端都是会话的TCP连接
+func sessionPair(t *testing.T, conf Config) (*Session, *Session) {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.DialTCP("tcp", nil, ln.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := ln.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewClientSession(network.NewTCPConn(client), conf),
+		NewServerSession(network.NewTCPConn(server), conf)
+}
+
+func acceptStream(t *testing.T, s *Session) *Stream {
+	accepted := make(chan *Stream, 1)
+	go func() {
+		st, _ := s.Accept()
+		accepted <- st
+	}()
+	select {
+	case st := <-accepted:
+		if st == nil {
+			t.Fatal("accept failed")
+		}
+		return st
+	case <-time.After(3 * time.Second):
+		t.Fatal("no stream accepted")
+	}
+	return nil
+}
+
+func TestServeStreams(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close() // 空闲的端口
+
+	// 每个流按行回显，和普通的TCP连接一样处理
+	inner := network.Events{
+		Prepare: func(c *network.Conn) (bufio.SplitFunc, network.FilterFunc) {
+			return bufio.ScanLines, nil
+		},
+		Receive: func(c *network.Conn, data []byte, saved bool) (string, error) {
+			return "", c.QuickSend(append(data, '\n'))
+		},
+	}
+	var sessions int32
+	ready := make(chan bool)
+	events := network.Events{
+		Serving: func(s *network.Server) { ready <- true },
+		Opened: func(s *network.Server, c *network.Conn) error {
+			atomic.AddInt32(&sessions, 1)
+			return nil
+		},
+		Process: Serve(inner, DefaultConfig),
+	}
+	server := tcp.NewServer(network.NewPortServer("127.0.0.1", uint16(port)))
+	go server.Run(events)
+	<-ready
+
+	plan := network.NewDialPlan(network.NewTCPAddr("127.0.0.1", uint16(port)), nil, 3)
+	dialer := NewDialer(plan, network.DefaultTCPOptions)
+	defer dialer.Close()
+	var wg sync.WaitGroup
+	errs := make(chan error, 50)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			client := dialer.NewClient()
+			if _, err := network.Reconnect(client, false, 1); err != nil {
+				errs <- err
+				return
+			}
+			defer client.Close()
+			conn := client.GetConn()
+			conn.GetRawConn().SetDeadline(time.Now().Add(3 * time.Second))
+			word := fmt.Sprintf("stream %d", i)
+			conn.QuickSend([]byte(word + "\n"))
+			if line, err := conn.GetReader().ReadString('\n'); line != word+"\n" {
+				errs <- fmt.Errorf("got %q, %v", line, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&sessions); n != 1 {
+		t.Fatalf("opened %d TCP connections", n)
+	}
+}
+
+func TestFlowControl(t *testing.T) {
+	conf := DefaultConfig
+	conf.Window = 64 * 1024
+	client, server := sessionPair(t, conf)
+	defer client.Close()
+	defer server.Close()
+	st, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := acceptStream(t, server)
+
+	// 对方不读时，最多写出一个窗口
+	st.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	n, err := st.Write(make([]byte, 1<<20))
+	if n != int(conf.Window) || err != ErrTimeout {
+		t.Fatalf("wrote %d bytes, %v", n, err)
+	}
+	if _, err = io.ReadFull(peer, make([]byte, n)); err != nil {
+		t.Fatal(err)
+	}
+
+	// 读走之后窗口恢复，大量数据完整传输，半关闭后对方读到EOF
+	st.SetWriteDeadline(time.Time{})
+	payload := bytes.Repeat([]byte("0123456789abcdef"), 1<<16)
+	go func() {
+		st.Write(payload)
+		st.CloseWrite()
+	}()
+	peer.SetReadDeadline(time.Now().Add(3 * time.Second))
+	data, err := ioutil.ReadAll(peer)
+	if err != nil || !bytes.Equal(data, payload) {
+		t.Fatalf("read %d bytes, %v", len(data), err)
+	}
+	// 半关闭后仍然可以收到回应
+	peer.Write([]byte("done"))
+	peer.Close()
+	st.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if reply, err := ioutil.ReadAll(st); string(reply) != "done" || err != nil {
+		t.Fatalf("got %q, %v", reply, err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if client.NumStreams() != 0 || server.NumStreams() != 0 {
+		t.Fatalf("streams left: %d, %d", client.NumStreams(), server.NumStreams())
+	}
+}
+
+func TestResetAndDeadline(t *testing.T) {
+	client, server := sessionPair(t, DefaultConfig)
+	defer client.Close()
+	defer server.Close()
+	st, _ := client.Open()
+	peer := acceptStream(t, server)
+
+	st.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err := st.Read(make([]byte, 10))
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Fatalf("got %v", err)
+	}
+	peer.Reset()
+	st.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = st.Read(make([]byte, 10)); err != ErrStreamReset {
+		t.Fatalf("got %v", err)
+	}
+	if _, err = st.Write([]byte("x")); err != ErrStreamReset {
+		t.Fatalf("got %v", err)
+	}
+}
+
+// 一端是服务端会话，另一端是原始的TCP连接，用来发送任意的帧
+func rawSession(t *testing.T, conf Config) (*net.TCPConn, *Session) {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	conn, err := net.DialTCP("tcp", nil, ln.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := ln.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, NewServerSession(network.NewTCPConn(server), conf)
+}
+
+// 声明的长度超过单帧上限，不分配内存，直接以协议错误关闭
+func TestOversizedFrame(t *testing.T) {
+	for _, flags := range []uint16{flagSYN, 0} { // 打开的流和不存在的流
+		conn, session := rawSession(t, DefaultConfig)
+		h := newHeader(typeData, flags, 1, 1<<32-1)
+		if _, err := conn.Write(h[:]); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-session.Done():
+			if session.Err() != ErrProtocol {
+				t.Fatalf("closed with %v", session.Err())
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("oversized frame was accepted")
+		}
+		conn.Close()
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	client, server := sessionPair(t, DefaultConfig)
+	defer server.Close()
+	if rtt, err := client.Ping(); err != nil || rtt <= 0 {
+		t.Fatalf("ping %s, %v", rtt, err)
+	}
+	client.Close()
+
+	// 对方不再回应时，会话被关闭
+	conf := DefaultConfig
+	conf.KeepAliveInterval = 20 * time.Millisecond
+	conf.WriteTimeout = 50 * time.Millisecond
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			time.Sleep(time.Second) // 接入但不回应
+			conn.Close()
+		}
+	}()
+	conn, err := net.DialTCP("tcp", nil, ln.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := NewClientSession(network.NewTCPConn(conn), conf)
+	select {
+	case <-session.Done():
+		if session.Err() != ErrKeepAliveTimeout {
+			t.Fatalf("closed with %v", session.Err())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("dead peer was not detected")
+	}
+}
+
+// 没有写超时，保活不能在第一次Ping时就超时
+func TestKeepAliveNoWriteTimeout(t *testing.T) {
+	conf := DefaultConfig
+	conf.KeepAliveInterval = 20 * time.Millisecond
+	conf.WriteTimeout = 0
+	client, server := sessionPair(t, conf)
+	defer server.Close()
+	defer client.Close()
+	select {
+	case <-client.Done():
+		t.Fatalf("closed with %v", client.Err())
+	case <-time.After(200 * time.Millisecond):
+	}
+	if rtt, err := client.Ping(); err != nil || rtt <= 0 {
+		t.Fatalf("ping %s, %v", rtt, err)
+	}
+}
+
+func TestGoAway(t *testing.T) {
+	client, server := sessionPair(t, DefaultConfig)
+	defer client.Close()
+	st, _ := client.Open()
+	peer := acceptStream(t, server)
+
+	drained := make(chan bool, 1)
+	go func() { drained <- server.Shutdown(3 * time.Second) }()
+	time.Sleep(20 * time.Millisecond)
+	if _, err := client.Open(); err != ErrRemoteGoAway {
+		t.Fatalf("open after go-away: %v", err)
+	}
+	// 已有的流不受影响
+	st.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(peer, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("got %q, %v", buf, err)
+	}
+	peer.Close()
+	st.Close()
+	select {
+	case ok := <-drained:
+		if !ok {
+			t.Fatal("streams were not drained")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("shutdown did not finish")
+	}
+}
@@ -0,0 +1,408 @@
+package mux
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/azhai/gozzo-net/network"
+)
+
+// 一个连接上的多路复用会话
+// 客户端打开的流ID为奇数，服务端为偶数，任何一方都可以打开和接受流
+type Session struct {
+	config  Config
+	conn    *network.Conn
+	reader  *bufio.Reader
+	nextID  uint32
+	streams map[uint32]*Stream
+	mutex   sync.Mutex
+	active  sync.WaitGroup // 未结束的流
+	accept  chan *Stream
+
+	sendMutex sync.Mutex
+	pingID    uint32
+	pings     map[uint32]chan struct{}
+
+	goAwayLocal  int32 // 本方不再接受新的流
+	goAwayRemote int32 // 对方不再接受新的流
+	shutting     int32 // 正在优雅关闭，本方也不再打开新的流
+
+	done      chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// 在连接上创建客户端会话
+func NewClientSession(c *network.Conn, conf Config) *Session {
+	return newSession(c, conf, 1)
+}
+
+// 在连接上创建服务端会话
+func NewServerSession(c *network.Conn, conf Config) *Session {
+	return newSession(c, conf, 2)
+}
+
+func newSession(c *network.Conn, conf Config, firstID uint32) *Session {
+	if conf.Window < maxFrameData {
+		conf.Window = maxFrameData
+	}
+	s := &Session{
+		config:  conf,
+		conn:    c,
+		reader:  c.GetReader(),
+		nextID:  firstID,
+		streams: make(map[uint32]*Stream),
+		accept:  make(chan *Stream, conf.AcceptBacklog),
+		pings:   make(map[uint32]chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go s.recvLoop()
+	if conf.KeepAliveInterval > 0 {
+		go s.keepalive()
+	}
+	return s
+}
+
+// 会话关闭时，返回的chan也被关闭
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *Session) IsClosed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// 会话关闭的原因
+func (s *Session) Err() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.closeErr
+}
+
+// 未结束的流的个数
+func (s *Session) NumStreams() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.streams)
+}
+
+func (s *Session) LocalAddr() net.Addr {
+	return s.conn.GetLocalAddr()
+}
+
+func (s *Session) RemoteAddr() net.Addr {
+	return s.conn.GetRemoteAddr()
+}
+
+// 打开一个新的流，不等待对方确认，对方拒绝时流被重置
+func (s *Session) Open() (*Stream, error) {
+	if s.IsClosed() || atomic.LoadInt32(&s.shutting) != 0 {
+		return nil, ErrSessionShutdown
+	}
+	if atomic.LoadInt32(&s.goAwayRemote) != 0 {
+		return nil, ErrRemoteGoAway
+	}
+	s.mutex.Lock()
+	id := s.nextID
+	if id >= 1<<32-2 {
+		s.mutex.Unlock()
+		return nil, ErrStreamsExhausted
+	}
+	s.nextID += 2
+	st := newStream(s, id)
+	s.streams[id] = st
+	s.active.Add(1)
+	s.mutex.Unlock()
+	if err := s.send(newHeader(typeWindowUpdate, flagSYN, id, 0), nil); err != nil {
+		s.forget(id)
+		return nil, err
+	}
+	return st, nil
+}
+
+// 等待对方打开的流
+func (s *Session) Accept() (*Stream, error) {
+	select {
+	case st := <-s.accept:
+		return st, nil
+	case <-s.done:
+		return nil, ErrSessionShutdown
+	}
+}
+
+// 测量往返时间，等待回应最多WriteTimeout，为0时一直等待
+func (s *Session) Ping() (time.Duration, error) {
+	return s.ping(s.config.WriteTimeout)
+}
+
+func (s *Session) ping(timeout time.Duration) (time.Duration, error) {
+	ch := make(chan struct{})
+	s.mutex.Lock()
+	id := s.pingID
+	s.pingID++
+	s.pings[id] = ch
+	s.mutex.Unlock()
+	defer func() {
+		s.mutex.Lock()
+		delete(s.pings, id)
+		s.mutex.Unlock()
+	}()
+
+	start := time.Now()
+	if err := s.send(newHeader(typePing, flagSYN, 0, id), nil); err != nil {
+		return 0, err
+	}
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case <-ch:
+		return time.Since(start), nil
+	case <-expired:
+		return 0, ErrTimeout
+	case <-s.done:
+		return 0, ErrSessionShutdown
+	}
+}
+
+// 通知对方不再接受新的流，已有的流不受影响
+func (s *Session) GoAway() error {
+	atomic.StoreInt32(&s.goAwayLocal, 1)
+	return s.send(newHeader(typeGoAway, 0, 0, goAwayNormal), nil)
+}
+
+// 优雅关闭：发送GoAway，等已有的流都结束后再关闭，最多等待timeout
+// 返回是否所有的流都正常结束
+func (s *Session) Shutdown(timeout time.Duration) bool {
+	atomic.StoreInt32(&s.shutting, 1)
+	s.GoAway()
+	drained := make(chan struct{})
+	go func() {
+		s.active.Wait()
+		close(drained)
+	}()
+	ok := true
+	select {
+	case <-drained:
+	case <-s.done:
+	case <-time.After(timeout):
+		ok = false
+	}
+	s.Close()
+	return ok
+}
+
+// 立即关闭会话和所有的流
+func (s *Session) Close() error {
+	s.closeWith(ErrSessionShutdown)
+	return nil
+}
+
+func (s *Session) closeWith(err error) {
+	s.closeOnce.Do(func() {
+		s.mutex.Lock()
+		s.closeErr = err
+		streams := s.streams
+		s.streams = make(map[uint32]*Stream)
+		s.mutex.Unlock()
+		close(s.done)
+		s.conn.Close()
+		for range streams {
+			s.active.Done()
+		}
+	})
+}
+
+// 协议错误，通知对方后关闭
+func (s *Session) fail(code uint32, err error) {
+	s.send(newHeader(typeGoAway, 0, 0, code), nil)
+	s.closeWith(err)
+}
+
+// 写一帧，写失败时关闭会话
+func (s *Session) send(h header, payload []byte) error {
+	s.sendMutex.Lock()
+	defer s.sendMutex.Unlock()
+	if s.IsClosed() {
+		return ErrSessionShutdown
+	}
+	raw := s.conn.GetRawConn()
+	if s.config.WriteTimeout > 0 {
+		raw.SetWriteDeadline(time.Now().Add(s.config.WriteTimeout))
+	}
+	bufs := net.Buffers{h[:]}
+	if len(payload) > 0 {
+		bufs = append(bufs, payload)
+	}
+	if _, err := bufs.WriteTo(raw); err != nil {
+		go s.closeWith(err)
+		return err
+	}
+	return nil
+}
+
+// 流两个方向都结束了，从会话中移除
+func (s *Session) forget(id uint32) {
+	s.mutex.Lock()
+	_, ok := s.streams[id]
+	delete(s.streams, id)
+	s.mutex.Unlock()
+	if ok {
+		s.active.Done()
+	}
+}
+
+func (s *Session) getStream(id uint32) *Stream {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.streams[id]
+}
+
+// 定时Ping，对方没有回应时关闭会话
+// 没有设置WriteTimeout时，最多等待一个间隔
+func (s *Session) keepalive() {
+	timeout := s.config.WriteTimeout
+	if timeout <= 0 {
+		timeout = s.config.KeepAliveInterval
+	}
+	ticker := time.NewTicker(s.config.KeepAliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := s.ping(timeout); err != nil {
+				if err == ErrTimeout {
+					s.closeWith(ErrKeepAliveTimeout)
+				}
+				return
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// 读取并分发所有的帧，直到连接断开
+func (s *Session) recvLoop() {
+	var h header
+	for {
+		if _, err := io.ReadFull(s.reader, h[:]); err != nil {
+			s.closeWith(err)
+			return
+		}
+		if h.Version() != protoVersion {
+			s.fail(goAwayProtocolError, ErrProtocol)
+			return
+		}
+		var err error
+		switch h.Type() {
+		case typeData, typeWindowUpdate:
+			err = s.handleStream(h)
+		case typePing:
+			err = s.handlePing(h)
+		case typeGoAway:
+			atomic.StoreInt32(&s.goAwayRemote, 1)
+		default:
+			err = ErrProtocol
+		}
+		if err != nil {
+			s.fail(goAwayProtocolError, err)
+			return
+		}
+	}
+}
+
+func (s *Session) handlePing(h header) error {
+	if h.Flags()&flagSYN != 0 {
+		go s.send(newHeader(typePing, flagACK, 0, h.Length()), nil)
+		return nil
+	}
+	s.mutex.Lock()
+	if ch, ok := s.pings[h.Length()]; ok {
+		close(ch)
+		delete(s.pings, h.Length())
+	}
+	s.mutex.Unlock()
+	return nil
+}
+
+func (s *Session) handleStream(h header) error {
+	id, flags := h.StreamID(), h.Flags()
+	if id == 0 {
+		return ErrProtocol
+	}
+	// 对方不会发送更长的Data帧，先检查长度再分配或者丢弃
+	if h.Type() == typeData && h.Length() > maxFrameData {
+		return ErrProtocol
+	}
+	if flags&flagSYN != 0 {
+		if err := s.incoming(id); err != nil {
+			return err
+		}
+	}
+	st := s.getStream(id)
+	if st == nil { // 已经关闭或者被拒绝的流，丢弃数据
+		if h.Type() == typeData && h.Length() > 0 {
+			_, err := io.CopyN(ioutil.Discard, s.reader, int64(h.Length()))
+			return err
+		}
+		return nil
+	}
+	if h.Type() == typeWindowUpdate {
+		st.grow(h.Length())
+	} else if h.Length() > 0 {
+		data := make([]byte, h.Length())
+		if _, err := io.ReadFull(s.reader, data); err != nil {
+			return err
+		}
+		if err := st.push(data); err != nil {
+			return err
+		}
+	}
+	if flags&flagFIN != 0 {
+		st.remoteClose()
+	}
+	if flags&flagRST != 0 {
+		st.remoteReset()
+	}
+	return nil
+}
+
+// 对方打开了流，本方GoAway之后或者积压太多时重置
+func (s *Session) incoming(id uint32) error {
+	s.mutex.Lock()
+	if _, ok := s.streams[id]; ok || id%2 == s.nextID%2 {
+		s.mutex.Unlock()
+		return ErrProtocol
+	}
+	if atomic.LoadInt32(&s.goAwayLocal) != 0 || s.IsClosed() {
+		s.mutex.Unlock()
+		go s.send(newHeader(typeWindowUpdate, flagRST, id, 0), nil)
+		return nil
+	}
+	st := newStream(s, id)
+	select {
+	case s.accept <- st:
+		s.streams[id] = st
+		s.active.Add(1)
+		s.mutex.Unlock()
+		go s.send(newHeader(typeWindowUpdate, flagACK, id, 0), nil)
+	default:
+		s.mutex.Unlock()
+		go s.send(newHeader(typeWindowUpdate, flagRST, id, 0), nil)
+	}
+	return nil
+}
@@ -0,0 +1,311 @@
+package mux
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/azhai/gozzo-net/network"
+)
+
+// 会话中的一个流，实现了network.INetConn，可以包装为network.Conn
+type Stream struct {
+	id      uint32
+	session *Session
+
+	mutex        sync.Mutex
+	recvBuf      bytes.Buffer
+	recvWindow   uint32 // 对方还可以发送的字节数
+	consumed     uint32 // 读走但还没有通知对方的字节数
+	sendWindow   uint32 // 本方还可以发送的字节数
+	localClosed  bool   // 已发送FIN
+	readClosed   bool   // 本方已关闭，不再读取
+	remoteClosed bool   // 已收到FIN
+	reset        bool
+	closeTimer   *time.Timer
+
+	recvNotify    chan struct{}
+	sendNotify    chan struct{}
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newStream(s *Session, id uint32) *Stream {
+	return &Stream{
+		id:         id,
+		session:    s,
+		recvWindow: s.config.Window,
+		sendWindow: s.config.Window,
+		recvNotify: make(chan struct{}, 1),
+		sendNotify: make(chan struct{}, 1),
+	}
+}
+
+// 包装为network.Conn，可以交给Server.Execute或者客户端使用
+func (st *Stream) Conn() *network.Conn {
+	return network.NewStreamConn("mux", st)
+}
+
+func (st *Stream) StreamID() uint32 {
+	return st.id
+}
+
+func (st *Stream) Session() *Session {
+	return st.session
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// 等待通知、超时或者会话关闭
+func (st *Stream) wait(ch chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return ErrTimeout
+		}
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-ch:
+		return nil
+	case <-timeout:
+		return ErrTimeout
+	case <-st.session.done:
+		return ErrSessionShutdown
+	}
+}
+
+func (st *Stream) Read(b []byte) (n int, err error) {
+	for {
+		st.mutex.Lock()
+		if st.recvBuf.Len() > 0 {
+			n, _ = st.recvBuf.Read(b)
+			delta := st.release(uint32(n))
+			st.mutex.Unlock()
+			if delta > 0 {
+				st.session.send(newHeader(typeWindowUpdate, 0, st.id, delta), nil)
+			}
+			return n, nil
+		}
+		closed, remote, reset, deadline := st.readClosed, st.remoteClosed, st.reset, st.readDeadline
+		st.mutex.Unlock()
+		switch {
+		case closed:
+			return 0, ErrStreamClosed
+		case reset:
+			return 0, ErrStreamReset
+		case remote:
+			return 0, io.EOF
+		}
+		if err = st.wait(st.recvNotify, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// 读走了n个字节，积累到半个窗口时归还给对方
+func (st *Stream) release(n uint32) (delta uint32) {
+	st.consumed += n
+	if st.consumed >= st.session.config.Window/2 && !st.remoteClosed {
+		delta, st.consumed = st.consumed, 0
+		st.recvWindow += delta
+	}
+	return
+}
+
+func (st *Stream) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		st.mutex.Lock()
+		if st.localClosed {
+			st.mutex.Unlock()
+			return n, ErrStreamClosed
+		}
+		if st.reset {
+			st.mutex.Unlock()
+			return n, ErrStreamReset
+		}
+		size := uint32(len(b))
+		if size > st.sendWindow {
+			size = st.sendWindow
+		}
+		if size > maxFrameData {
+			size = maxFrameData
+		}
+		st.sendWindow -= size
+		deadline := st.writeDeadline
+		st.mutex.Unlock()
+		if size == 0 { // 等待对方读走数据
+			if err = st.wait(st.sendNotify, deadline); err != nil {
+				return
+			}
+			continue
+		}
+		if err = st.session.send(newHeader(typeData, 0, st.id, size), b[:size]); err != nil {
+			return
+		}
+		n += int(size)
+		b = b[size:]
+	}
+	return
+}
+
+// 半关闭，对方读到EOF，本方仍然可以读
+func (st *Stream) CloseWrite() error {
+	st.mutex.Lock()
+	if st.localClosed || st.reset {
+		st.mutex.Unlock()
+		return nil
+	}
+	st.localClosed = true
+	finished := st.remoteClosed
+	st.mutex.Unlock()
+	err := st.session.send(newHeader(typeData, flagFIN, st.id, 0), nil)
+	if finished {
+		st.session.forget(st.id)
+	}
+	return err
+}
+
+// 关闭两个方向，对方没有在StreamCloseTimeout内关闭时重置
+func (st *Stream) Close() error {
+	st.mutex.Lock()
+	if st.readClosed {
+		st.mutex.Unlock()
+		return nil
+	}
+	st.readClosed = true
+	st.recvBuf.Reset()
+	waiting := !st.remoteClosed && !st.reset
+	if waiting && st.session.config.StreamCloseTimeout > 0 {
+		st.closeTimer = time.AfterFunc(st.session.config.StreamCloseTimeout, st.Reset)
+	}
+	st.mutex.Unlock()
+	notify(st.recvNotify)
+	return st.CloseWrite()
+}
+
+// 立即重置，对方的读写都会出错
+func (st *Stream) Reset() {
+	st.mutex.Lock()
+	if st.reset {
+		st.mutex.Unlock()
+		return
+	}
+	st.reset, st.localClosed, st.readClosed = true, true, true
+	st.mutex.Unlock()
+	notify(st.recvNotify)
+	notify(st.sendNotify)
+	st.session.send(newHeader(typeWindowUpdate, flagRST, st.id, 0), nil)
+	st.session.forget(st.id)
+}
+
+// 收到数据，超过接收窗口是协议错误；本方已关闭时丢弃并归还窗口
+func (st *Stream) push(data []byte) error {
+	size := uint32(len(data))
+	st.mutex.Lock()
+	if size > st.recvWindow {
+		st.mutex.Unlock()
+		return ErrProtocol
+	}
+	if st.readClosed {
+		st.mutex.Unlock()
+		go st.session.send(newHeader(typeWindowUpdate, 0, st.id, size), nil)
+		return nil
+	}
+	st.recvWindow -= size
+	st.recvBuf.Write(data)
+	st.mutex.Unlock()
+	notify(st.recvNotify)
+	return nil
+}
+
+func (st *Stream) grow(delta uint32) {
+	st.mutex.Lock()
+	st.sendWindow += delta
+	st.mutex.Unlock()
+	notify(st.sendNotify)
+}
+
+func (st *Stream) remoteClose() {
+	st.mutex.Lock()
+	st.remoteClosed = true
+	finished := st.localClosed
+	if finished && st.closeTimer != nil {
+		st.closeTimer.Stop()
+	}
+	st.mutex.Unlock()
+	notify(st.recvNotify)
+	if finished {
+		st.session.forget(st.id)
+	}
+}
+
+func (st *Stream) remoteReset() {
+	st.mutex.Lock()
+	st.reset = true
+	if st.closeTimer != nil {
+		st.closeTimer.Stop()
+	}
+	st.mutex.Unlock()
+	notify(st.recvNotify)
+	notify(st.sendNotify)
+	st.session.forget(st.id)
+}
+
+func (st *Stream) LocalAddr() net.Addr {
+	return st.session.LocalAddr()
+}
+
+func (st *Stream) RemoteAddr() net.Addr {
+	return st.session.RemoteAddr()
+}
+
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	return st.SetWriteDeadline(t)
+}
+
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.mutex.Lock()
+	st.readDeadline = t
+	st.mutex.Unlock()
+	notify(st.recvNotify) // 让等待中的Read按新的deadline计时
+	return nil
+}
+
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.mutex.Lock()
+	st.writeDeadline = t
+	st.mutex.Unlock()
+	notify(st.sendNotify)
+	return nil
+}
+
+// 流没有自己的缓冲区参数，接收窗口见Config.Window
+func (st *Stream) SetReadBuffer(bytes int) error {
+	return nil
+}
+
+func (st *Stream) SetWriteBuffer(bytes int) error {
+	return nil
+}
+
+func (st *Stream) File() (*os.File, error) {
+	return nil, ErrNotSupported
+}
+
+func (st *Stream) SyscallConn() (syscall.RawConn, error) {
+	return nil, ErrNotSupported
+}
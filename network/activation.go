@@ -0,0 +1,166 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// systemd传入的第一个句柄
+const ListenFdsStart = 3
+
+// systemd socket activation传入的监听，按LISTEN_FDNAMES或监听地址取用
+type activation struct {
+	files []*os.File
+	names []string
+	once  sync.Once
+	mutex sync.Mutex
+}
+
+var activated = new(activation)
+
+// 读取LISTEN_PID/LISTEN_FDS/LISTEN_FDNAMES，之后删除这些环境变量
+func (a *activation) parse() {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	for i := 0; i < count; i++ {
+		fd := ListenFdsStart + i
+		closeOnExec(fd)
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+		a.names = append(a.names, name)
+		a.files = append(a.files, os.NewFile(uintptr(fd), name))
+	}
+}
+
+// 取出第一个符合条件的句柄，create失败或者match不满足的跳过
+func (a *activation) take(name string, create func(f *os.File) (net.Addr, func() error, error),
+	match func(net.Addr) bool) (bool, error) {
+	a.once.Do(a.parse)
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	for i, f := range a.files {
+		if f == nil {
+			continue
+		}
+		addr, closer, err := create(f)
+		if err != nil {
+			continue // 不是需要的socket
+		}
+		if (name != "" && a.names[i] == name) || match(addr) {
+			a.files[i] = nil
+			return true, f.Close()
+		}
+		closer()
+	}
+	return false, nil
+}
+
+// 是否由systemd socket activation启动
+func IsSocketActivated() bool {
+	activated.once.Do(activated.parse)
+	return len(activated.files) > 0
+}
+
+// 取得systemd传入的流式监听，类型为kind，名称与LISTEN_FDNAMES相同或者地址相同
+// 同一个unit的socket可能共用一个名称，类型不同的跳过
+// 没有被激活或者找不到时返回nil
+func Activated(kind, name string, addr net.Addr) (ln net.Listener, err error) {
+	create := func(f *os.File) (net.Addr, func() error, error) {
+		var err error
+		if ln, err = net.FileListener(f); err != nil {
+			return nil, nil, err
+		}
+		if !sameNetwork(kind, ln.Addr().Network()) {
+			ln.Close()
+			return nil, nil, fmt.Errorf("The socket is %s, not %s", ln.Addr().Network(), kind)
+		}
+		return ln.Addr(), ln.Close, nil
+	}
+	ok, err := activated.take(name, create, func(a net.Addr) bool {
+		return SameAddr(addr, a)
+	})
+	if !ok {
+		ln = nil
+	}
+	return
+}
+
+// 取得systemd传入的数据报socket，规则同Activated()
+func ActivatedPacket(kind, name string, addr net.Addr) (conn net.PacketConn, err error) {
+	create := func(f *os.File) (net.Addr, func() error, error) {
+		var err error
+		if conn, err = net.FilePacketConn(f); err != nil {
+			return nil, nil, err
+		}
+		if !sameNetwork(kind, conn.LocalAddr().Network()) {
+			conn.Close()
+			return nil, nil, fmt.Errorf("The socket is %s, not %s", conn.LocalAddr().Network(), kind)
+		}
+		return conn.LocalAddr(), conn.Close, nil
+	}
+	ok, err := activated.take(name, create, func(a net.Addr) bool {
+		return SameAddr(addr, a)
+	})
+	if !ok {
+		conn = nil
+	}
+	return
+}
+
+// 网络类型是否相同，tcp4/tcp6等同于tcp
+func sameNetwork(want, got string) bool {
+	trim := func(s string) string {
+		return strings.TrimRight(s, "46")
+	}
+	return trim(want) == trim(got)
+}
+
+// 监听地址是否相同，通配地址与任意IP相同
+func SameAddr(want, got net.Addr) bool {
+	if want == nil || got == nil {
+		return false
+	}
+	switch got := got.(type) {
+	case *net.TCPAddr:
+		if want := GetTCPAddr(want); want != nil {
+			return sameIPPort(want.IP, want.Port, got.IP, got.Port)
+		}
+	case *net.UDPAddr:
+		if want := GetUDPAddr(want); want != nil {
+			return sameIPPort(want.IP, want.Port, got.IP, got.Port)
+		}
+	case *net.UnixAddr:
+		if want := GetUnixAddr(want); want != nil {
+			return want.Name == got.Name
+		}
+	}
+	return false
+}
+
+func sameIPPort(wantIP net.IP, wantPort int, gotIP net.IP, gotPort int) bool {
+	if wantPort != gotPort {
+		return false
+	}
+	if len(wantIP) == 0 || wantIP.IsUnspecified() || gotIP.IsUnspecified() {
+		return true
+	}
+	return wantIP.Equal(gotIP)
+}
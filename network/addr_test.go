@@ -1,6 +1,9 @@
 package network
 
-import "testing"
+import (
+	"net"
+	"testing"
+)
 
 func TestLocalAddrs(t *testing.T) {
 	addrs := GetLocalAddrs()
@@ -20,3 +23,39 @@ func TestLocalRing(t *testing.T) {
 		t.Log(taddr.Network(), taddr.String())
 	}
 }
+
+func TestSameAddr(t *testing.T) {
+	cases := []struct {
+		want, got string
+		same      bool
+	}{
+		{":9988", "[::]:9988", true},
+		{"127.0.0.1:9988", "0.0.0.0:9988", true},
+		{"127.0.0.1:9988", "127.0.0.1:9988", true},
+		{"127.0.0.1:9988", "127.0.0.2:9988", false},
+		{"127.0.0.1:9988", "127.0.0.1:9989", false},
+	}
+	for _, c := range cases {
+		want, _ := net.ResolveTCPAddr("tcp", c.want)
+		got, _ := net.ResolveTCPAddr("tcp", c.got)
+		if SameAddr(want, got) != c.same {
+			t.Errorf("SameAddr(%s, %s) should be %v", c.want, c.got, c.same)
+		}
+	}
+	sock := NewUnixSockAddr("/tmp/gozzo.sock")
+	if !SameAddr(sock, NewUnixAddr("/tmp/gozzo.sock")) {
+		t.Error("unix addresses with the same name should match")
+	}
+}
+
+// 零值不修改属主，不能当作root
+func TestUnixOwner(t *testing.T) {
+	var opts UnixOptions
+	if uid, gid := opts.Owner(); uid != -1 || gid != -1 {
+		t.Fatalf("zero options change the owner to %d:%d", uid, gid)
+	}
+	opts.SetOwner(0, -1)
+	if uid, gid := opts.Owner(); uid != 0 || gid != -1 {
+		t.Fatalf("owner is %d:%d", uid, gid)
+	}
+}
@@ -27,6 +27,26 @@ func GetLocalAddrs() (result []*net.IPNet) {
 	return result
 }
 
+// 根据IP找到所在的网卡
+func GetInterface(ip net.IP) (*net.Interface, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	for i := range ifaces {
+		addrs, err := ifaces[i].Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+				return &ifaces[i], nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("No interface has the address %s", ip)
+}
+
 // 局域网IP的循环列表
 type LocalAddrRing struct {
 	ring       *metrics.Ring
@@ -3,12 +3,19 @@ package network
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"net"
 	"os"
+	"sync"
 	"syscall"
 	"time"
+
+	"github.com/azhai/gozzo-pck/match"
 )
 
+// 单条消息的最大长度，用于unixgram/unixpacket
+const MaxMessageSize = 65536
+
 // 网络连接，即IPConn/TCPConn/UDPConn/UnixConn
 type INetConn interface {
 	File() (f *os.File, err error)
@@ -31,7 +38,7 @@ type Options struct {
 	Deadline    int
 }
 
-// 设置UDP连接参数
+// 设置UDP连接参数，超时要记在Conn中，由ApplyDeadline设置
 func (opts Options) ApplyConn(c INetConn) (err error) {
 	if opts.ReadBuffer > 0 {
 		err = c.SetReadBuffer(opts.ReadBuffer)
@@ -39,13 +46,18 @@ func (opts Options) ApplyConn(c INetConn) (err error) {
 	if err == nil && opts.WriteBuffer > 0 {
 		err = c.SetWriteBuffer(opts.WriteBuffer)
 	}
-	if err == nil && opts.Deadline > 0 {
-		secs := time.Duration(opts.Deadline)
-		err = c.SetDeadline(time.Now().Add(secs * time.Second))
-	}
 	return
 }
 
+// 按Deadline设置连接的超时，临时修改读超时后可以恢复，见GetReadDeadline
+func (opts Options) ApplyDeadline(c *Conn) error {
+	if opts.Deadline <= 0 {
+		return nil
+	}
+	secs := time.Duration(opts.Deadline)
+	return c.SetDeadline(time.Now().Add(secs * time.Second))
+}
+
 // 检测TCP连接是否断开
 // Idle: 没有数据往来（上行、下行都没有）多少秒后，发第一个检测包
 // Count: 最大检测次数
@@ -90,8 +102,11 @@ type Conn struct {
 	Session *Session
 	// 下发指令专用，回复请直接调用Write
 	Input, Output chan []byte
-	IsActive  bool
-	LastError error
+	IsActive      bool
+	LastError     error
+	readDeadline  time.Time
+	done          chan struct{}
+	closeOnce     sync.Once
 }
 
 func newConn(kind string, conn INetConn, isActive bool) *Conn {
@@ -101,6 +116,7 @@ func newConn(kind string, conn INetConn, isActive bool) *Conn {
 		Input:    make(chan []byte),
 		Output:   make(chan []byte),
 		IsActive: isActive,
+		done:     make(chan struct{}),
 	}
 }
 
@@ -116,6 +132,47 @@ func NewUnixConn(conn *net.UnixConn) *Conn {
 	return newConn("unix", conn, conn != nil)
 }
 
+func NewUnixgramConn(conn *net.UnixConn) *Conn {
+	return newConn("unixgram", conn, conn != nil)
+}
+
+func NewUnixpacketConn(conn *net.UnixConn) *Conn {
+	return newConn("unixpacket", conn, conn != nil)
+}
+
+// 包装其他实现了INetConn的连接，例如多路复用中的流
+func NewStreamConn(kind string, conn INetConn) *Conn {
+	return newConn(kind, conn, conn != nil)
+}
+
+// 将文件句柄包装为网络连接，例如继承或接收到的socket，f会被关闭
+func NewFileConn(f *os.File) (*Conn, error) {
+	defer f.Close() // FileConn()会复制句柄
+	conn, err := net.FileConn(f)
+	if err != nil {
+		return nil, err
+	}
+	switch conn := conn.(type) {
+	case *net.TCPConn:
+		return NewTCPConn(conn), nil
+	case *net.UDPConn:
+		return NewUDPConn(conn), nil
+	case *net.UnixConn:
+		if addr := conn.LocalAddr(); addr != nil {
+			switch addr.Network() {
+			case "unixgram":
+				return NewUnixgramConn(conn), nil
+			case "unixpacket":
+				return NewUnixpacketConn(conn), nil
+			}
+		}
+		return NewUnixConn(conn), nil
+	}
+	conn.Close()
+	return nil, fmt.Errorf("Unknown connection type %T", conn)
+}
+
+// 关闭连接，Input和Output不再关闭，改用Done()通知（避免往已关闭的chan写入）
 func (c *Conn) Close() error {
 	if c.Session != nil {
 		// 多Proto情况下，需要保留App参数时，不能Clear
@@ -123,17 +180,28 @@ func (c *Conn) Close() error {
 	}
 	if c.IsActive {
 		c.IsActive = false
-		close(c.Input)
-		close(c.Output)
+		c.closeOnce.Do(func() {
+			close(c.done)
+		})
 		return c.conn.Close()
 	}
 	return nil
 }
 
+// 连接关闭时，返回的chan也被关闭
+func (c *Conn) Done() <-chan struct{} {
+	return c.done
+}
+
 func (c *Conn) GetKind() string {
 	return c.kind
 }
 
+// 是否保留消息边界的连接，即unixgram/unixpacket
+func (c *Conn) IsPacket() bool {
+	return c.kind == "unixgram" || c.kind == "unixpacket"
+}
+
 func (c *Conn) GetSessId() string {
 	if sess := c.Session; sess != nil {
 		return sess.GetId()
@@ -157,11 +225,34 @@ func (c *Conn) GetRemoteAddr() net.Addr {
 
 func (c *Conn) Control(f func(fd uintptr)) error {
 	if c.sysconn == nil && c.IsActive {
-		c.sysconn = c.conn.SyscallConn()
+		sysconn, err := c.conn.SyscallConn()
+		if err != nil {
+			return err
+		}
+		c.sysconn = sysconn
+	}
+	if c.sysconn == nil {
+		return fmt.Errorf("Lost connection")
 	}
 	return c.sysconn.Control(f)
 }
 
+// 设置读写超时，读超时会记下来
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.readDeadline = t
+	return c.conn.SetDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.readDeadline = t
+	return c.conn.SetReadDeadline(t)
+}
+
+// 通过Conn设置的读超时，Peek首包等临时改动读超时后用它恢复
+func (c *Conn) GetReadDeadline() time.Time {
+	return c.readDeadline
+}
+
 func (c *Conn) GetReader() *bufio.Reader {
 	if c.reader == nil && c.IsActive {
 		c.reader = bufio.NewReader(c.conn)
@@ -169,6 +260,43 @@ func (c *Conn) GetReader() *bufio.Reader {
 	return c.reader
 }
 
+// 与GetReader()相同，第一次创建读缓冲时使用size字节，用于Peek较长的首包
+// 读缓冲已经创建时原样返回，不能替换，别处持有的reader会丢失数据
+func (c *Conn) GetReaderSize(size int) *bufio.Reader {
+	if c.reader == nil && c.IsActive {
+		c.reader = bufio.NewReaderSize(c.conn, size)
+	}
+	return c.reader
+}
+
+// 读取数据帧，交给write处理，直到读完或出错
+// 保留消息边界的连接或split为空时，每条消息就是一帧，否则按split拆包
+// 都从GetReader()读，Peek过的数据不会丢失；读缓冲为空时大的buf直接读conn，不会合并消息
+func (c *Conn) ReadFrames(split bufio.SplitFunc, write func(data []byte)) error {
+	reader := c.GetReader()
+	if reader == nil {
+		return fmt.Errorf("Lost connection")
+	}
+	if split != nil && !c.IsPacket() {
+		sp := match.NewSplitMatcher(split)
+		return sp.Scanning(reader, write)
+	}
+	buf := make([]byte, MaxMessageSize)
+	for {
+		n, err := reader.Read(buf)
+		if n > 0 {
+			data := make([]byte, n)
+			copy(data, buf[:n])
+			write(data)
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
 // 往前读n个字节，但不移动游标
 // 注意：原始conn的读游标会向前移动，所有读的地方，用GetReader()代替GetRawConn()
 func (c *Conn) Peek(n int) ([]byte, error) {
@@ -0,0 +1,39 @@
+package network
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// 已经Peek到读缓冲中的数据，不拆包时也要交给write
+func TestReadFramesBuffered(t *testing.T) {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := ln.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewTCPConn(conn)
+	defer c.Close()
+	client.Write([]byte("hello"))
+	if data, err := c.Peek(2); err != nil || string(data) != "he" {
+		t.Fatalf("peek %q, %v", data, err)
+	}
+	client.Close()
+	c.GetRawConn().SetReadDeadline(time.Now().Add(2 * time.Second))
+	var got string
+	err = c.ReadFrames(nil, func(data []byte) {
+		got += string(data)
+	})
+	if err != nil || got != "hello" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+}
@@ -4,6 +4,8 @@ package network
 
 import (
 	"net"
+	"os"
+	"syscall"
 	"time"
 
 	"github.com/felixge/tcpkeepalive"
@@ -20,3 +22,16 @@ func (ka KeepAlive) ApplyTo(c *net.TCPConn) (err error) {
 	tcpkeepalive.SetKeepAlive(c, idle, ka.Count, interval)
 	return
 }
+
+// 转换为setsockopt等使用的socket
+func sockFd(fd uintptr) int {
+	return int(fd)
+}
+
+// 触发平滑升级的信号
+var UpgradeSignals = []os.Signal{syscall.SIGUSR2}
+
+// 继承来的句柄不再传给其他子进程
+func closeOnExec(fd int) {
+	syscall.CloseOnExec(fd)
+}
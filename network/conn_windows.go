@@ -4,6 +4,8 @@ package network
 
 import (
 	"net"
+	"os"
+	"syscall"
 	"time"
 )
 
@@ -19,3 +21,14 @@ func (ka KeepAlive) ApplyTo(c *net.TCPConn) (err error) {
 	}
 	return
 }
+
+// 转换为setsockopt等使用的socket
+func sockFd(fd uintptr) syscall.Handle {
+	return syscall.Handle(fd)
+}
+
+// 触发平滑升级的信号，Windows不支持继承监听
+var UpgradeSignals = []os.Signal{}
+
+func closeOnExec(fd int) {
+}
@@ -0,0 +1,50 @@
+package network
+
+import (
+	"fmt"
+)
+
+// 对端进程的身份，来自Unix连接的SO_PEERCRED
+type PeerCred struct {
+	Pid, Uid, Gid int
+}
+
+// 获取Unix连接对端进程的身份，只支持unix和unixpacket
+func (c *Conn) GetPeerCred() (*PeerCred, error) {
+	if c.kind != "unix" && c.kind != "unixpacket" {
+		return nil, fmt.Errorf("Peer credentials is not available for %s", c.kind)
+	}
+	var (
+		cred *PeerCred
+		err  error
+	)
+	cerr := c.Control(func(fd uintptr) {
+		cred, err = getPeerCred(fd)
+	})
+	if cerr != nil {
+		return nil, cerr
+	}
+	return cred, err
+}
+
+// 只允许指定用户或组的进程连接，uid或gid任一匹配即可，用作Events.Authorize
+func AllowPeers(uids, gids []int) func(s *Server, c *Conn) error {
+	return func(s *Server, c *Conn) error {
+		cred, err := c.GetPeerCred()
+		if err != nil {
+			return err
+		}
+		for _, uid := range uids {
+			if cred.Uid == uid {
+				return nil
+			}
+		}
+		for _, gid := range gids {
+			if cred.Gid == gid {
+				return nil
+			}
+		}
+		return fmt.Errorf("Peer pid=%d uid=%d gid=%d is not allowed",
+			cred.Pid, cred.Uid, cred.Gid)
+	}
+}
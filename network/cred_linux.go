@@ -0,0 +1,14 @@
+// +build linux
+
+package network
+
+import "syscall"
+
+// 读取SO_PEERCRED
+func getPeerCred(fd uintptr) (*PeerCred, error) {
+	ucred, err := syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	if err != nil {
+		return nil, err
+	}
+	return &PeerCred{Pid: int(ucred.Pid), Uid: int(ucred.Uid), Gid: int(ucred.Gid)}, nil
+}
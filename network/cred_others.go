@@ -0,0 +1,10 @@
+// +build !linux
+
+package network
+
+import "fmt"
+
+// 目前只支持Linux的SO_PEERCRED
+func getPeerCred(fd uintptr) (*PeerCred, error) {
+	return nil, fmt.Errorf("Peer credentials is only supported on Linux")
+}
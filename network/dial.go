@@ -65,7 +65,11 @@ func (dp *DialPlan) Dial(kind string) (net.Conn, error) {
 	if dp.LocalAddr == nil {
 		return net.DialTimeout(kind, address, dp.Timeout)
 	} else {
-		d := &net.Dialer{LocalAddr: dp.LocalAddr, Timeout: dp.Timeout}
+		laddr := dp.LocalAddr
+		if addr, ok := laddr.(*UnixAddr); ok {
+			laddr = addr.UnixAddr
+		}
+		d := &net.Dialer{LocalAddr: laddr, Timeout: dp.Timeout}
 		return d.Dial(kind, address)
 	}
 }
@@ -106,12 +110,17 @@ func (dp *DialPlan) DialUDP() (*net.UDPConn, error) {
 
 // 拨号得到Unix连接
 func (dp *DialPlan) DialUnix() (*net.UnixConn, error) {
+	return dp.DialUnixKind("unix")
+}
+
+// 拨号得到Unix连接，kind为unix、unixgram或unixpacket
+func (dp *DialPlan) DialUnixKind(kind string) (*net.UnixConn, error) {
 	if dp.Timeout <= 0 {
-		laddr := dp.LocalAddr.(*net.UnixAddr)
-		addr := dp.RemoteAddr.(*net.UnixAddr)
-		return net.DialUnix("unix", laddr, addr)
+		laddr := GetUnixAddr(dp.LocalAddr)
+		addr := GetUnixAddr(dp.RemoteAddr)
+		return net.DialUnix(kind, laddr, addr)
 	}
-	conn, err := dp.Dial("unix")
+	conn, err := dp.Dial(kind)
 	if err == nil {
 		return conn.(*net.UnixConn), err
 	}
@@ -122,6 +131,7 @@ func (dp *DialPlan) SetPortRemote(host string, port uint16) {
 	dp.RemoteAddr = NewTCPAddr(host, port)
 }
 
-func (dp *DialPlan) SetUnixRemote(filename string) {
-	dp.RemoteAddr = NewUnixAddr(filename)
+// 以@开头的名称为Linux抽象命名空间
+func (dp *DialPlan) SetUnixRemote(filename string, opts ...UnixOptions) {
+	dp.RemoteAddr = NewUnixSockAddr(filename, opts...)
 }
@@ -0,0 +1,8 @@
+// +build android dragonfly freebsd linux netbsd openbsd
+
+package network
+
+import "syscall"
+
+// 接收到的句柄在recvmsg中就设置close-on-exec，不会被同时启动的子进程继承
+const recvMsgFlags = syscall.MSG_CMSG_CLOEXEC
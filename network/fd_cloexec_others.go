@@ -0,0 +1,6 @@
+// +build darwin solaris
+
+package network
+
+// 不支持MSG_CMSG_CLOEXEC，接收后再设置close-on-exec
+const recvMsgFlags = 0
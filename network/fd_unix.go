@@ -0,0 +1,119 @@
+// +build android darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package network
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+// 单次最多接收的文件句柄数
+const MaxPassFiles = 16
+
+func (c *Conn) getUnixConn() (*net.UnixConn, error) {
+	if conn, ok := c.conn.(*net.UnixConn); ok && c.IsActive {
+		return conn, nil
+	}
+	return nil, fmt.Errorf("Passing files needs an active unix connection")
+}
+
+// 通过Unix连接发送文件句柄（SCM_RIGHTS）和数据，数据为空时发送一个0字节
+// 发送后本进程的文件仍然打开，由调用方关闭
+func (c *Conn) SendFiles(data []byte, files ...*os.File) error {
+	conn, err := c.getUnixConn()
+	if err != nil {
+		return err
+	}
+	fds := make([]int, len(files))
+	for i, f := range files {
+		fds[i] = int(f.Fd())
+	}
+	if len(data) == 0 {
+		data = []byte{0} // 流式socket必须带上至少1个字节
+	}
+	n, oobn, err := conn.WriteMsgUnix(data, syscall.UnixRights(fds...), nil)
+	if err == nil && (n < len(data) || oobn == 0 && len(fds) > 0) {
+		err = fmt.Errorf("Only sent %d bytes", n)
+	}
+	return err
+}
+
+// 发送另一个网络连接的句柄，对方可以用NewFileConn()接管
+func (c *Conn) SendConn(data []byte, other *Conn) error {
+	f, err := other.GetRawConn().File()
+	if err != nil {
+		return err
+	}
+	defer f.Close() // File()得到的是复制的句柄
+	return c.SendFiles(data, f)
+}
+
+// 接收文件句柄和数据，数据读入buf
+// 注意：读缓冲中已有数据时不能接收，请不要与GetReader()混用
+func (c *Conn) RecvFiles(buf []byte) (n int, files []*os.File, err error) {
+	conn, err := c.getUnixConn()
+	if err != nil {
+		return
+	}
+	if c.reader != nil && c.reader.Buffered() > 0 {
+		err = fmt.Errorf("There are %d bytes in read buffer", c.reader.Buffered())
+		return
+	}
+	oob := make([]byte, syscall.CmsgSpace(MaxPassFiles*4))
+	oobn := 0
+	if n, oobn, err = recvMsg(conn, buf, oob); err != nil {
+		return
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return
+	}
+	for _, msg := range msgs {
+		fds, perr := syscall.ParseUnixRights(&msg)
+		if perr != nil {
+			continue
+		}
+		for _, fd := range fds {
+			if recvMsgFlags == 0 {
+				syscall.CloseOnExec(fd)
+			}
+			files = append(files, os.NewFile(uintptr(fd), "passed"))
+		}
+	}
+	return
+}
+
+// 带上recvMsgFlags调用recvmsg，ReadMsgUnix()不能指定flags
+func recvMsg(conn *net.UnixConn, buf, oob []byte) (n, oobn int, err error) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return
+	}
+	rerr := rc.Read(func(fd uintptr) bool {
+		n, oobn, _, _, err = syscall.Recvmsg(int(fd), buf, oob, recvMsgFlags)
+		return err != syscall.EAGAIN
+	})
+	if rerr != nil {
+		err = rerr // 超时或者连接已关闭
+	}
+	return
+}
+
+// 接收一个网络连接的句柄，并包装为Conn，可交给Server.Execute()处理
+func (c *Conn) RecvConn(buf []byte) (n int, conn *Conn, err error) {
+	n, files, err := c.RecvFiles(buf)
+	if err != nil {
+		return
+	}
+	if len(files) == 0 {
+		err = fmt.Errorf("No file is received")
+		return
+	}
+	for _, f := range files[1:] {
+		f.Close()
+	}
+	conn, err = NewFileConn(files[0])
+	return
+}
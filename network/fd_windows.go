@@ -0,0 +1,25 @@
+// +build windows
+
+package network
+
+import (
+	"fmt"
+	"os"
+)
+
+// Windows不支持通过Unix连接传递文件句柄
+func (c *Conn) SendFiles(data []byte, files ...*os.File) error {
+	return fmt.Errorf("Passing files is not supported on Windows")
+}
+
+func (c *Conn) SendConn(data []byte, other *Conn) error {
+	return fmt.Errorf("Passing files is not supported on Windows")
+}
+
+func (c *Conn) RecvFiles(buf []byte) (int, []*os.File, error) {
+	return 0, nil, fmt.Errorf("Passing files is not supported on Windows")
+}
+
+func (c *Conn) RecvConn(buf []byte) (int, *Conn, error) {
+	return 0, nil, fmt.Errorf("Passing files is not supported on Windows")
+}
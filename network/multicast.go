@@ -0,0 +1,216 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// 组播参数
+// Groups: 加入的组播地址
+// Interfaces: 收发组播的网卡，为空时由系统选择，可用AddInterface按局域网IP添加
+// TTL: 发送组播的TTL，0表示使用系统默认值1
+// Loopback: 发送的组播是否回环给本机
+type Multicast struct {
+	Groups     []net.IP
+	Interfaces []*net.Interface
+	TTL        int
+	Loopback   bool
+}
+
+// 创建组播参数，忽略不是组播地址的group
+func NewMulticast(groups ...string) *Multicast {
+	m := new(Multicast)
+	for _, group := range groups {
+		if ip := net.ParseIP(group); ip != nil && ip.IsMulticast() {
+			m.Groups = append(m.Groups, ip)
+		}
+	}
+	return m
+}
+
+// 根据局域网IP找到对应网卡并添加，IP可以来自GetLocalAddrs()
+func (m *Multicast) AddInterface(ip net.IP) error {
+	ifi, err := GetInterface(ip)
+	if err == nil {
+		m.Interfaces = append(m.Interfaces, ifi)
+	}
+	return err
+}
+
+// 监听组播端口并加入所有组播，addr本身为组播地址时也加入该组
+// 监听的是通配地址，同一端口可以有多个进程接收
+func ListenMulticast(addr *net.UDPAddr, m *Multicast) (*net.UDPConn, error) {
+	m = m.ForAddr(addr)
+	kind, err := m.family()
+	if err != nil {
+		return nil, err
+	}
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) (err error) {
+			cerr := c.Control(func(fd uintptr) {
+				err = syscall.SetsockoptInt(sockFd(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+			})
+			if err == nil {
+				err = cerr
+			}
+			return
+		},
+	}
+	address := fmt.Sprintf(":%d", addr.Port)
+	pc, err := lc.ListenPacket(context.Background(), kind, address)
+	if err != nil {
+		return nil, err
+	}
+	conn := pc.(*net.UDPConn)
+	if err = m.Join(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// 组播地址都是IPv4时为udp4，都是IPv6时为udp6，一个socket不能混用
+func (m *Multicast) family() (string, error) {
+	kind := ""
+	for _, group := range m.Groups {
+		k := "udp4"
+		if group.To4() == nil {
+			k = "udp6"
+		}
+		if kind != "" && k != kind {
+			return "", fmt.Errorf("Can not join IPv4 and IPv6 groups together: %s", group)
+		}
+		kind = k
+	}
+	if kind == "" {
+		kind = "udp4"
+	}
+	return kind, nil
+}
+
+// 监听地址本身为组播地址时，返回加入了该组的副本
+func (m *Multicast) ForAddr(addr *net.UDPAddr) *Multicast {
+	if m == nil {
+		m = new(Multicast)
+	}
+	if addr.IP != nil && addr.IP.IsMulticast() {
+		mc := *m
+		mc.Groups = append([]net.IP{addr.IP}, m.Groups...)
+		m = &mc
+	}
+	return m
+}
+
+// 在每一个网卡上加入所有组播
+func (m *Multicast) Join(c *net.UDPConn) error {
+	return m.control(c, func(fd uintptr) (err error) {
+		for _, group := range m.Groups {
+			if len(m.Interfaces) == 0 {
+				err = joinGroup(fd, group, nil)
+			}
+			for _, ifi := range m.Interfaces {
+				if err = joinGroup(fd, group, ifi); err != nil {
+					break
+				}
+			}
+			if err != nil {
+				return fmt.Errorf("join %s: %s", group, err)
+			}
+		}
+		return
+	})
+}
+
+// 设置发送组播的TTL、回环和网卡（只用第一个网卡）
+func (m *Multicast) ApplySender(c *net.UDPConn) error {
+	raddr, ok := c.RemoteAddr().(*net.UDPAddr)
+	inet6 := ok && raddr.IP.To4() == nil
+	return m.control(c, func(fd uintptr) (err error) {
+		ttl, loop := m.TTL, 0
+		if ttl <= 0 {
+			ttl = 1
+		}
+		if m.Loopback {
+			loop = 1
+		}
+		level, optTTL, optLoop := syscall.IPPROTO_IP, syscall.IP_MULTICAST_TTL, syscall.IP_MULTICAST_LOOP
+		if inet6 {
+			level, optTTL, optLoop = syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_HOPS, syscall.IPV6_MULTICAST_LOOP
+		}
+		if err = syscall.SetsockoptInt(sockFd(fd), level, optTTL, ttl); err != nil {
+			return
+		}
+		if err = syscall.SetsockoptInt(sockFd(fd), level, optLoop, loop); err != nil {
+			return
+		}
+		if len(m.Interfaces) > 0 {
+			err = setInterface(fd, m.Interfaces[0], inet6)
+		}
+		return
+	})
+}
+
+func (m *Multicast) control(c *net.UDPConn, f func(fd uintptr) error) error {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var operr error
+	err = raw.Control(func(fd uintptr) {
+		operr = f(fd)
+	})
+	if err == nil {
+		err = operr
+	}
+	return err
+}
+
+// 找出网卡上的IPv4地址
+func interfaceIPv4(ifi *net.Interface) (ip [4]byte, err error) {
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok {
+			if ip4 := ipnet.IP.To4(); ip4 != nil {
+				copy(ip[:], ip4)
+				return
+			}
+		}
+	}
+	err = fmt.Errorf("No IPv4 address on %s", ifi.Name)
+	return
+}
+
+func joinGroup(fd uintptr, group net.IP, ifi *net.Interface) (err error) {
+	if ip4 := group.To4(); ip4 != nil {
+		mreq := &syscall.IPMreq{}
+		copy(mreq.Multiaddr[:], ip4)
+		if ifi != nil {
+			if mreq.Interface, err = interfaceIPv4(ifi); err != nil {
+				return
+			}
+		}
+		return syscall.SetsockoptIPMreq(sockFd(fd), syscall.IPPROTO_IP, syscall.IP_ADD_MEMBERSHIP, mreq)
+	}
+	mreq := &syscall.IPv6Mreq{}
+	copy(mreq.Multiaddr[:], group.To16())
+	if ifi != nil {
+		mreq.Interface = uint32(ifi.Index)
+	}
+	return syscall.SetsockoptIPv6Mreq(sockFd(fd), syscall.IPPROTO_IPV6, syscall.IPV6_JOIN_GROUP, mreq)
+}
+
+func setInterface(fd uintptr, ifi *net.Interface, inet6 bool) error {
+	if inet6 {
+		return syscall.SetsockoptInt(sockFd(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_IF, ifi.Index)
+	}
+	ip, err := interfaceIPv4(ifi)
+	if err != nil {
+		return err
+	}
+	return syscall.SetsockoptInet4Addr(sockFd(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_IF, ip)
+}
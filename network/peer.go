@@ -0,0 +1,282 @@
+package network
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// 每个对端最多缓存的数据包个数，超出时丢弃新包
+const PeerQueueSize = 64
+
+// 读超时错误
+type timeoutError struct{}
+
+func (e timeoutError) Error() string   { return "i/o timeout" }
+func (e timeoutError) Timeout() bool   { return true }
+func (e timeoutError) Temporary() bool { return true }
+
+// 虚拟连接，多个对端共用同一个监听socket（UDP或unixgram）
+// 数据包由服务端通过Push()投递，写入时用WriteTo发往对端
+type PeerConn struct {
+	conn     IBaseConn
+	addr     net.Addr
+	queue    chan []byte
+	pending  []byte
+	done     chan struct{}
+	once     sync.Once
+	lastTime int64 // 最近一次收发的时间戳（纳秒）
+	deadline atomic.Value
+}
+
+func NewPeerConn(conn IBaseConn, addr net.Addr) *PeerConn {
+	peer := &PeerConn{
+		conn:  conn,
+		addr:  addr,
+		queue: make(chan []byte, PeerQueueSize),
+		done:  make(chan struct{}),
+	}
+	peer.deadline.Store(time.Time{})
+	peer.touch()
+	return peer
+}
+
+// 创建UDP虚拟连接
+func NewUDPPeerConn(peer *PeerConn) *Conn {
+	return newConn("udp", peer, peer != nil)
+}
+
+func (p *PeerConn) touch() {
+	atomic.StoreInt64(&p.lastTime, time.Now().UnixNano())
+}
+
+// 距离最近一次收发过了多久
+func (p *PeerConn) IdleTime() time.Duration {
+	last := atomic.LoadInt64(&p.lastTime)
+	return time.Since(time.Unix(0, last))
+}
+
+// 投递收到的数据包，队列已满或连接已关闭时返回false
+func (p *PeerConn) Push(data []byte) bool {
+	buf := make([]byte, len(data))
+	copy(buf, data)
+	select {
+	case <-p.done:
+		return false
+	default:
+	}
+	select {
+	case p.queue <- buf:
+		p.touch()
+		return true
+	default:
+		return false
+	}
+}
+
+// 读取数据包，相邻数据包首尾相接，当作数据流处理
+func (p *PeerConn) Read(b []byte) (n int, err error) {
+	if len(p.pending) == 0 {
+		var timeout <-chan time.Time
+		if t := p.deadline.Load().(time.Time); !t.IsZero() {
+			timer := time.NewTimer(time.Until(t))
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case p.pending = <-p.queue:
+		case <-p.done:
+			return 0, io.EOF
+		case <-timeout:
+			return 0, timeoutError{}
+		}
+	}
+	n = copy(b, p.pending)
+	p.pending = p.pending[n:]
+	return
+}
+
+func (p *PeerConn) Write(b []byte) (n int, err error) {
+	select {
+	case <-p.done:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+	n, err = p.conn.WriteTo(b, p.addr)
+	if err == nil {
+		p.touch()
+	}
+	return
+}
+
+// 只关闭虚拟连接，共用的socket由服务端关闭
+func (p *PeerConn) Close() error {
+	p.once.Do(func() {
+		close(p.done)
+	})
+	return nil
+}
+
+func (p *PeerConn) isClosed() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *PeerConn) LocalAddr() net.Addr {
+	return p.conn.LocalAddr()
+}
+
+func (p *PeerConn) RemoteAddr() net.Addr {
+	return p.addr
+}
+
+func (p *PeerConn) SetDeadline(t time.Time) error {
+	return p.SetReadDeadline(t)
+}
+
+func (p *PeerConn) SetReadDeadline(t time.Time) error {
+	p.deadline.Store(t)
+	return nil
+}
+
+// 写入不会阻塞，忽略写超时
+func (p *PeerConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// 以下方法作用于共用的socket
+func (p *PeerConn) File() (*os.File, error) {
+	return p.conn.File()
+}
+
+func (p *PeerConn) SetReadBuffer(bytes int) error {
+	return p.conn.SetReadBuffer(bytes)
+}
+
+func (p *PeerConn) SetWriteBuffer(bytes int) error {
+	return p.conn.SetWriteBuffer(bytes)
+}
+
+func (p *PeerConn) SyscallConn() (syscall.RawConn, error) {
+	return p.conn.SyscallConn()
+}
+
+// 对端虚拟连接的集合，以对端地址为key
+type PeerTable struct {
+	kind     string
+	conn     IBaseConn
+	count    int64 // 进行中的会话数
+	sessions sync.WaitGroup
+	closed   bool
+	mutex    sync.Mutex
+	MaxPeers int // 大于0时限制会话数，超出时丢弃新对端的数据包
+	Registry
+}
+
+// 创建对端集合，kind为udp或unixgram
+func NewPeerTable(kind string, conn IBaseConn) *PeerTable {
+	return &PeerTable{kind: kind, conn: conn}
+}
+
+// 将数据包交给对应的虚拟连接，新的对端会开始一个会话
+func (t *PeerTable) Dispatch(s *Server, events Events, addr net.Addr, data []byte) {
+	key := addr.String()
+	if key == "" { // 没有绑定地址的unixgram对端，共用一个会话
+		key = "@"
+	}
+	// 会话的状态由它自己的goroutine修改，这里只看虚拟连接是否关闭
+	if c := t.LoadConn(key); c != nil {
+		if peer := c.GetRawConn().(*PeerConn); !peer.isClosed() {
+			peer.Push(data) // 队列已满时丢弃，与数据报本身的语义一致
+			return
+		}
+	}
+	if t.MaxPeers > 0 && t.Count() >= t.MaxPeers {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.closed { // 已经停止，不再开始新的会话
+		return
+	}
+	atomic.AddInt64(&t.count, 1)
+	t.sessions.Add(1)
+	peer := NewPeerConn(t.conn, addr)
+	c := newConn(t.kind, peer, true)
+	c.Session = NewSession(true)
+	t.SaveConn(c, key)
+	peer.Push(data)
+	go func(c *Conn) {
+		defer t.sessions.Done()
+		s.Execute(events, c)
+		t.release(c, key)
+	}(c)
+}
+
+// 关闭所有虚拟连接，等待会话各自结束，Closed事件由会话自己执行一次
+// 之后新对端的数据包被丢弃
+func (t *PeerTable) Close() {
+	t.mutex.Lock()
+	t.closed = true
+	t.mutex.Unlock()
+	t.Each(func(k string, c *Conn) bool {
+		c.GetRawConn().Close()
+		return true
+	})
+	t.sessions.Wait()
+}
+
+// 进行中的会话数
+func (t *PeerTable) Count() int {
+	return int(atomic.LoadInt64(&t.count))
+}
+
+// 会话结束，从对端列表中删除
+func (t *PeerTable) release(c *Conn, key string) {
+	atomic.AddInt64(&t.count, -1)
+	if t.LoadConn(key) == c {
+		t.CloseConn(c, key)
+	} else {
+		c.Close()
+	}
+}
+
+// 关闭空闲超时的虚拟连接，会话随之结束并执行Closed事件
+func (t *PeerTable) Expire(timeout time.Duration) {
+	t.Each(func(k string, c *Conn) bool {
+		peer, ok := c.GetRawConn().(*PeerConn)
+		if ok && peer.IdleTime() > timeout {
+			peer.Close()
+		}
+		return true
+	})
+}
+
+// 定期检查空闲的虚拟连接，直到stop被关闭
+func (t *PeerTable) ExpireLoop(timeout time.Duration, stop <-chan struct{}) {
+	if timeout <= 0 {
+		return
+	}
+	interval := timeout / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			t.Expire(timeout)
+		}
+	}
+}
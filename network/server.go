@@ -6,23 +6,26 @@ import (
 	//"runtime"
 	"sync"
 	"time"
-
-	"github.com/azhai/gozzo-pck/match"
 )
 
 type CloseFunc func(c *Conn) error
 type EachFunc func(k string, c *Conn) bool
 type FilterFunc func(data []byte) bool
+type ProcessFunc func(s *Server, c *Conn)
 
-// 事件集
+// 事件集，Process不为空时，由它接管连接，不再拆包
+// Prepare返回的split为空时，每次读到的消息就是一帧
+// Authorize在接入后最先执行，返回错误时直接关闭连接，例如AllowPeers()
 type Events struct {
-	Tick    func(t time.Time)
-	Serving func(s *Server)
-	Opened  func(s *Server, c *Conn) error
-	Closed  func(s *Server, c *Conn, err error)
-	Prepare func(c *Conn) (bufio.SplitFunc, FilterFunc)
-	Receive func(c *Conn, data []byte, saved bool) (string, error)
-	Send    func(c *Conn, data []byte) error
+	Tick      func(t time.Time)
+	Serving   func(s *Server)
+	Authorize func(s *Server, c *Conn) error
+	Opened    func(s *Server, c *Conn) error
+	Process   ProcessFunc
+	Closed    func(s *Server, c *Conn, err error)
+	Prepare   func(c *Conn) (bufio.SplitFunc, FilterFunc)
+	Receive   func(c *Conn, data []byte, saved bool) (string, error)
+	Send      func(c *Conn, data []byte) error
 }
 
 // 网络临时错误，可以忽略此连接，继续接入下一个
@@ -31,6 +34,24 @@ func IsTemporaryError(err error) bool {
 	return ok && netErr.Temporary()
 }
 
+// 接入出现临时错误（如文件句柄用尽）时，逐次加倍等待，避免空转
+type Backoff struct {
+	delay time.Duration
+}
+
+func (b *Backoff) Wait() {
+	if b.delay == 0 {
+		b.delay = 5 * time.Millisecond
+	} else if b.delay *= 2; b.delay > time.Second {
+		b.delay = time.Second
+	}
+	time.Sleep(b.delay)
+}
+
+func (b *Backoff) Reset() {
+	b.delay = 0
+}
+
 // 网络连接集合
 type Registry struct {
 	conns sync.Map
@@ -102,8 +123,9 @@ func (r *Registry) IsOverride(c *Conn, key string) bool {
 
 // 服务器
 type Server struct {
-	Address net.Addr
-	Ticker  <-chan time.Time
+	Address    net.Addr
+	ListenName string // systemd socket activation时按LISTEN_FDNAMES匹配，为空时按地址匹配
+	Ticker     <-chan time.Time
 	*Registry
 }
 
@@ -118,17 +140,21 @@ func NewPortServer(host string, port uint16) *Server {
 	return NewAddrServer(addr)
 }
 
-// 创建unix socket服务器
-func NewUnixServer(filename string) *Server {
-	addr := NewUnixAddr(filename)
+// 创建unix socket服务器，没有参数时使用DefaultUnixOptions
+// 以@开头的名称为Linux抽象命名空间
+func NewUnixServer(filename string, opts ...UnixOptions) *Server {
+	addr := NewUnixSockAddr(filename, opts...)
 	return NewAddrServer(addr)
 }
 
 // 根据设备id下发数据
 func (s *Server) SendTo(key string, data []byte) bool {
 	if c := s.LoadConn(key); c != nil {
-		c.Output <- data
-		return true
+		select {
+		case c.Output <- data:
+			return true
+		case <-c.Done():
+		}
 	}
 	return false
 }
@@ -151,51 +177,83 @@ func (s *Server) Trigger(events Events) {
 	}
 }
 
+// 处理连接，直到对方断开、出错或连接被关闭
 func (s *Server) Execute(events Events, c *Conn) {
+	if events.Authorize != nil {
+		if c.LastError = events.Authorize(s, c); c.LastError != nil {
+			c.Close()
+			return
+		}
+	}
 	if events.Opened != nil {
 		c.LastError = events.Opened(s, c)
 		if c.LastError != nil {
 			return
 		}
 	}
-	split, filter := events.Prepare(c)
-	go func(c *Conn, s *Server){
-		defer s.Finish(events, c)
-		var key, saved = "", false
-		for {
+	defer s.Finish(events, c)
+	if events.Process != nil {
+		events.Process(s, c)
+		return
+	}
+	var (
+		split  bufio.SplitFunc
+		filter FilterFunc
+	)
+	if events.Prepare != nil {
+		split, filter = events.Prepare(c)
+	}
+	eof := make(chan error, 1)
+	go func(c *Conn) {
+		eof <- c.ReadFrames(split, func(data []byte) {
 			select {
-			case data := <-c.Output:
-				if events.Send == nil {
-					continue
-				}
-				if filter == nil || filter(data) {
-					c.LastError = events.Send(c, data)
-					if c.LastError != nil {
-						return
-					}
-				}
-			case data := <-c.Input:
-				if events.Receive == nil {
-					continue
-				}
-				key, c.LastError = events.Receive(c, data, saved)
+			case c.Input <- data:
+			case <-c.Done():
+			}
+		})
+	}(c)
+	var key, saved = "", false
+	for {
+		select {
+		case err := <-eof: // 读完或读出错
+			if c.LastError == nil {
+				c.LastError = err
+			}
+			return
+		case <-c.Done(): // 被关闭，例如服务停止
+			return
+		case data := <-c.Output:
+			if events.Send == nil {
+				continue
+			}
+			if filter == nil || filter(data) {
+				c.LastError = events.Send(c, data)
 				if c.LastError != nil {
 					return
 				}
-				if saved == false && key != "" {
-					s.SaveConn(c, key)
-					saved = true
-				}
 			}
-			//runtime.Gosched()
+		case data := <-c.Input:
+			if events.Receive == nil {
+				continue
+			}
+			key, c.LastError = events.Receive(c, data, saved)
+			if c.LastError != nil {
+				return
+			}
+			if saved == false && key != "" {
+				s.SaveConn(c, key)
+				saved = true
+			}
 		}
-	}(c, s)
-	sp := match.NewSplitMatcher(split)
-	c.LastError = sp.SplitStream(c.GetReader(), c.Input)
+		//runtime.Gosched()
+	}
 }
 
-// 关闭客户端
+// 关闭客户端，已关闭的连接不再重复执行Closed事件
 func (s *Server) Finish(events Events, c *Conn) error {
+	if c.IsActive == false {
+		return nil
+	}
 	if events.Closed != nil {
 		events.Closed(s, c, c.LastError)
 	}
@@ -0,0 +1,93 @@
+package network
+
+import (
+	"net"
+	"os"
+)
+
+// Unix socket监听参数，零值不修改sock文件
+// Mode: sock文件权限，为0时不修改，监听期间会临时改动整个进程的umask
+// Uid, Gid: sock文件属主和属组，为nil时不修改，用SetOwner()设置
+// RemoveStale: 启动前删除残留的sock文件（确认无人监听后才删除）
+type UnixOptions struct {
+	Mode        os.FileMode
+	Uid, Gid    *int
+	RemoveStale bool
+}
+
+var DefaultUnixOptions = UnixOptions{
+	RemoveStale: true,
+}
+
+// 设置sock文件的属主和属组，小于0的不修改，与os.Lchown一致
+func (o *UnixOptions) SetOwner(uid, gid int) {
+	o.Uid, o.Gid = nil, nil
+	if uid >= 0 {
+		o.Uid = &uid
+	}
+	if gid >= 0 {
+		o.Gid = &gid
+	}
+}
+
+// 要设置的属主和属组，不修改的为-1
+func (o UnixOptions) Owner() (uid, gid int) {
+	uid, gid = -1, -1
+	if o.Uid != nil {
+		uid = *o.Uid
+	}
+	if o.Gid != nil {
+		gid = *o.Gid
+	}
+	return
+}
+
+// 带监听参数的Unix socket地址
+// 以@开头的名称为Linux抽象命名空间，不对应文件
+type UnixAddr struct {
+	*net.UnixAddr
+	Options UnixOptions
+}
+
+// 创建Unix socket地址，没有参数时使用DefaultUnixOptions
+func NewUnixSockAddr(filename string, opts ...UnixOptions) *UnixAddr {
+	addr := &UnixAddr{UnixAddr: NewUnixAddr(filename)}
+	if len(opts) > 0 {
+		addr.Options = opts[0]
+	} else {
+		addr.Options = DefaultUnixOptions
+	}
+	return addr
+}
+
+// 是否抽象命名空间
+func (a *UnixAddr) IsAbstract() bool {
+	return IsAbstractUnix(a.Name)
+}
+
+// 名称以@开头的是Linux抽象命名空间
+func IsAbstractUnix(name string) bool {
+	return len(name) > 0 && name[0] == '@'
+}
+
+// 将网络地址转为Unix socket地址
+func GetUnixAddr(addr net.Addr) (unixAddr *net.UnixAddr) {
+	switch addr := addr.(type) {
+	case nil:
+	case *net.UnixAddr:
+		unixAddr = addr
+	case *UnixAddr:
+		unixAddr = addr.UnixAddr
+	default:
+		unixAddr, _ = net.ResolveUnixAddr("unix", addr.String())
+	}
+	return
+}
+
+// 获取地址中的监听参数，普通地址使用DefaultUnixOptions
+func GetUnixOptions(addr net.Addr) UnixOptions {
+	if addr, ok := addr.(*UnixAddr); ok {
+		return addr.Options
+	}
+	return DefaultUnixOptions
+}
@@ -0,0 +1,313 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 传给新进程的环境变量，记录继承的监听和通知就绪的管道
+const (
+	InheritEnv = "GOZZO_INHERIT"
+	ReadyEnv   = "GOZZO_READY_FD"
+)
+
+// 可以复制出文件句柄的监听，即TCPListener/UnixListener
+type Filer interface {
+	File() (*os.File, error)
+}
+
+// 平滑升级：将监听交给新进程，新进程就绪后旧进程不再接入，处理完已有连接后退出
+// Binary: 新的程序，为空时重新执行当前程序
+// Args: 新进程的参数，为空时使用当前参数
+// ReadyTimeout: 等待新进程就绪的最长时间
+// DrainTimeout: 旧进程等待已有连接结束的最长时间，超时后强制关闭
+type Upgrader struct {
+	Binary       string
+	Args         []string
+	ReadyTimeout time.Duration
+	DrainTimeout time.Duration
+	Failed       func(err error) // 收到信号但升级失败时执行
+	inherited    map[string]*os.File
+	listeners    map[string]Filer
+	readyFile    *os.File
+	envOnce      sync.Once
+	upgrading    bool
+	upgraded     chan struct{}
+	mutex        sync.Mutex
+}
+
+// 全局的升级器，第一次使用时读取从父进程继承的监听
+var DefaultUpgrader = NewUpgrader()
+
+func NewUpgrader() *Upgrader {
+	return &Upgrader{
+		ReadyTimeout: 30 * time.Second,
+		DrainTimeout: 60 * time.Second,
+		inherited:    make(map[string]*os.File),
+		listeners:    make(map[string]Filer),
+		upgraded:     make(chan struct{}),
+	}
+}
+
+func listenKey(kind, address string) string {
+	return kind + "://" + address
+}
+
+// 读取继承的句柄，只在第一次使用时执行，不用升级的程序不受环境变量影响
+func (u *Upgrader) loadEnv() {
+	u.envOnce.Do(u.parseEnv)
+}
+
+// 读取继承的句柄，之后删除环境变量，避免再传给其他子进程
+func (u *Upgrader) parseEnv() {
+	if names := os.Getenv(InheritEnv); names != "" {
+		for i, name := range strings.Split(names, ";") {
+			u.inherited[name] = os.NewFile(uintptr(3+i), name)
+		}
+		os.Unsetenv(InheritEnv)
+	}
+	if fd, err := strconv.Atoi(os.Getenv(ReadyEnv)); err == nil && fd > 2 {
+		u.readyFile = os.NewFile(uintptr(fd), "ready")
+		os.Unsetenv(ReadyEnv)
+	}
+}
+
+// 是否由升级启动的新进程
+func (u *Upgrader) IsChild() bool {
+	u.loadEnv()
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return u.readyFile != nil
+}
+
+// 取得从父进程继承的监听，没有时返回nil
+func (u *Upgrader) Inherit(kind, address string) (net.Listener, error) {
+	u.loadEnv()
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	key := listenKey(kind, address)
+	f, ok := u.inherited[key]
+	if !ok {
+		return nil, nil
+	}
+	delete(u.inherited, key)
+	defer f.Close() // FileListener()会复制句柄
+	return net.FileListener(f)
+}
+
+// 登记监听，升级时交给新进程
+func (u *Upgrader) Register(kind, address string, ln Filer) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.listeners[listenKey(kind, address)] = ln
+}
+
+// 服务正常停止，取消登记
+func (u *Upgrader) Unregister(kind, address string) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	delete(u.listeners, listenKey(kind, address))
+}
+
+// 新进程已接管监听时，返回的chan被关闭
+func (u *Upgrader) Upgraded() <-chan struct{} {
+	return u.upgraded
+}
+
+func (u *Upgrader) IsUpgraded() bool {
+	select {
+	case <-u.upgraded:
+		return true
+	default:
+		return false
+	}
+}
+
+// 新进程通知父进程已经可以接入，可重复调用
+func (u *Upgrader) Ready() error {
+	u.loadEnv()
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if u.readyFile == nil {
+		return nil
+	}
+	_, err := u.readyFile.Write([]byte{1})
+	u.readyFile.Close()
+	u.readyFile = nil
+	return err
+}
+
+// 启动新进程并交出所有监听，等到新进程就绪才返回
+// 等待新进程时不占用锁，服务仍然可以登记和取消监听
+func (u *Upgrader) Upgrade() (pid int, err error) {
+	u.loadEnv() // 先清掉继承的环境变量，不能再传给新进程
+	u.mutex.Lock()
+	if u.IsUpgraded() {
+		u.mutex.Unlock()
+		return 0, fmt.Errorf("The process has been upgraded")
+	}
+	if u.upgrading {
+		u.mutex.Unlock()
+		return 0, fmt.Errorf("The process is upgrading")
+	}
+	u.upgrading = true
+	u.mutex.Unlock()
+	defer func() {
+		u.mutex.Lock()
+		u.upgrading = false
+		u.mutex.Unlock()
+	}()
+	names, files, err := u.listenerFiles()
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	if err != nil {
+		return
+	}
+	ready, notify, err := os.Pipe()
+	if err != nil {
+		return
+	}
+	defer ready.Close()
+	files = append(files, notify)
+
+	binary, args := u.Binary, u.Args
+	if binary == "" {
+		if binary, err = os.Executable(); err != nil {
+			return
+		}
+	}
+	if len(args) == 0 {
+		args = os.Args[1:]
+	}
+	cmd := exec.Command(binary, args...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(),
+		InheritEnv+"="+strings.Join(names, ";"),
+		ReadyEnv+"="+strconv.Itoa(3+len(names)))
+	if err = cmd.Start(); err != nil {
+		return
+	}
+	go cmd.Wait() // 新进程失败退出时回收
+	notify.Close()
+	files = files[:len(files)-1]
+	if err = waitReady(ready, u.ReadyTimeout); err != nil {
+		cmd.Process.Kill()
+		return
+	}
+	close(u.upgraded)
+	return cmd.Process.Pid, nil
+}
+
+// 复制所有登记的监听的句柄
+func (u *Upgrader) listenerFiles() (names []string, files []*os.File, err error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	for key, ln := range u.listeners {
+		var f *os.File
+		if f, err = ln.File(); err != nil {
+			return
+		}
+		names = append(names, key)
+		files = append(files, f)
+	}
+	return
+}
+
+// 等待新进程写入就绪标记，新进程退出时管道被关闭
+func waitReady(ready *os.File, timeout time.Duration) error {
+	result := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1)
+		_, err := ready.Read(buf)
+		result <- err
+	}()
+	select {
+	case err := <-result:
+		if err != nil {
+			return fmt.Errorf("The new process exited before ready: %s", err)
+		}
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("The new process is not ready in %s", timeout)
+	}
+}
+
+// 收到信号时升级，升级成功后停止监听信号
+// 没有可用的信号时（如Windows）不做任何事
+func (u *Upgrader) WatchSignal(sigs ...os.Signal) {
+	if len(sigs) == 0 {
+		sigs = UpgradeSignals
+	}
+	if len(sigs) == 0 { // signal.Notify没有信号时会转发所有信号
+		return
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, sigs...)
+	go func() {
+		defer signal.Stop(ch)
+		for range ch {
+			_, err := u.Upgrade()
+			if err == nil {
+				return
+			}
+			if u.Failed != nil {
+				u.Failed(err)
+			}
+		}
+	}()
+}
+
+// 等待已有连接结束，超时后强制关闭剩下的连接并返回false
+func (u *Upgrader) Drain(active *ActiveConns) bool {
+	done := make(chan struct{})
+	go func() {
+		active.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(u.DrainTimeout):
+		active.CloseAll()
+		return false
+	}
+}
+
+// 正在处理的连接，平滑升级时等待它们结束
+type ActiveConns struct {
+	conns sync.Map
+	wg    sync.WaitGroup
+}
+
+func (a *ActiveConns) Add(c *Conn) {
+	a.wg.Add(1)
+	a.conns.Store(c, true)
+}
+
+func (a *ActiveConns) Done(c *Conn) {
+	a.conns.Delete(c)
+	a.wg.Done()
+}
+
+func (a *ActiveConns) Wait() {
+	a.wg.Wait()
+}
+
+// 关闭所有正在处理的连接，不管是否登记在Registry中
+func (a *ActiveConns) CloseAll() {
+	a.conns.Range(func(key, value interface{}) bool {
+		key.(*Conn).Close()
+		return true
+	})
+}
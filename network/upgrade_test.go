@@ -0,0 +1,59 @@
+package network
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// 超时后没有登记在Registry中的连接也被强制关闭
+func TestDrainTimeout(t *testing.T) {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := ln.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewTCPConn(conn)
+
+	var active ActiveConns
+	active.Add(c)
+	go func() {
+		<-c.Done() // 处理连接的goroutine在连接关闭后结束
+		active.Done(c)
+	}()
+	u := &Upgrader{DrainTimeout: 50 * time.Millisecond}
+	if u.Drain(&active) {
+		t.Fatal("drain should time out")
+	}
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = client.Read(make([]byte, 1)); err == nil {
+		t.Fatal("connection was not closed")
+	}
+	active.Wait()
+	if !u.Drain(&active) {
+		t.Fatal("nothing left to drain")
+	}
+}
+
+// 环境变量在第一次使用时才读取，创建升级器不受影响
+func TestUpgraderLazyEnv(t *testing.T) {
+	os.Setenv(ReadyEnv, "999")
+	defer os.Unsetenv(ReadyEnv)
+	u := NewUpgrader()
+	if os.Getenv(ReadyEnv) == "" {
+		t.Fatal("the environment was read on creation")
+	}
+	if !u.IsChild() || os.Getenv(ReadyEnv) != "" {
+		t.Fatal("the environment was not read on first use")
+	}
+}
@@ -0,0 +1,97 @@
+// +build android darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package tcp
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/azhai/gozzo-net/network"
+)
+
+// 设置了这个环境变量时，测试程序作为被systemd激活的服务进程运行
+const activationTestEnv = "GOZZO_ACTIVATION_TEST_ADDR"
+
+// 配置的地址与传入的监听不同，只能按名称匹配
+func runActivatedServer(address string) {
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid())) // 代替systemd填写
+	addr, err := net.ResolveTCPAddr("tcp", address)
+	if err != nil {
+		os.Exit(1)
+	}
+	serv := network.NewAddrServer(addr)
+	serv.ListenName = "echo"
+	server := NewServer(serv)
+	events := network.Events{
+		Prepare: func(c *network.Conn) (bufio.SplitFunc, network.FilterFunc) {
+			return bufio.ScanLines, nil
+		},
+		Receive: func(c *network.Conn, data []byte, saved bool) (string, error) {
+			return "", c.QuickSend(append(data, '\n'))
+		},
+	}
+	if err = server.Run(events); err != nil {
+		os.Exit(1)
+	}
+}
+
+// 同一个unit中的unix socket也叫echo，排在前面，应当跳过
+func TestSocketActivation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gozzo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "echo.sock")
+	uln, err := net.ListenUnix("unix", &net.UnixAddr{Name: sock, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	uf, err := uln.File()
+	uln.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uf.Close()
+
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := ln.File()
+	ln.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	cmd.ExtraFiles = []*os.File{uf, f}
+	cmd.Env = append(os.Environ(), activationTestEnv+"="+freePort(t),
+		"LISTEN_FDS=2", "LISTEN_FDNAMES=echo:echo")
+	if err = cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+
+	// 监听在启动前就存在，连接不会被拒绝
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("hello\n"))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || line != "hello\n" {
+		t.Fatalf("got %q, %v", line, err)
+	}
+}
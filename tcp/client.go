@@ -38,8 +38,11 @@ func (c *TCPClient) SetConn(conn *network.Conn) {
 func (c *TCPClient) Dialing() (*network.Conn, error) {
 	conn, err := c.dialplan.DialTCP()
 	if err == nil && conn != nil {
-		err = c.options.ApplyTCP(conn)
-		return network.NewTCPConn(conn), err
+		nc := network.NewTCPConn(conn)
+		if err = c.options.ApplyTCP(conn); err == nil {
+			err = c.options.ApplyDeadline(nc)
+		}
+		return nc, err
 	}
 	return nil, err
 }
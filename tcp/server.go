@@ -1,8 +1,10 @@
 package tcp
 
 import (
+	"fmt"
 	"net"
 	"runtime"
+	"time"
 
 	"github.com/azhai/gozzo-net/network"
 )
@@ -10,6 +12,7 @@ import (
 // TCP服务器
 type TCPServer struct {
 	listener *net.TCPListener
+	active   network.ActiveConns // 正在处理的连接，平滑升级时等待它们结束
 	*network.Server
 }
 
@@ -19,18 +22,39 @@ func NewServer(server *network.Server) *TCPServer {
 }
 
 // 服务启动阶段，执行Tick事件
+// 由平滑升级启动时，使用从父进程继承的监听
+// 由systemd socket activation启动时，使用传入的监听
 func (s *TCPServer) Startup(events network.Events) (err error) {
-	addr := network.GetTCPAddr(s.Address)
-	s.listener, err = ListenTCP(addr.String())
-	if err == nil {
-		s.Trigger(events)
+	address := network.GetTCPAddr(s.Address).String()
+	upgrader := network.DefaultUpgrader
+	var ln net.Listener
+	if ln, err = upgrader.Inherit("tcp", address); err != nil {
+		return
+	}
+	if ln == nil {
+		if ln, err = network.Activated("tcp", s.ListenName, s.Address); err != nil {
+			return
+		}
+	}
+	if ln != nil {
+		var ok bool
+		if s.listener, ok = ln.(*net.TCPListener); !ok {
+			ln.Close()
+			return fmt.Errorf("The listener of %s is not a TCPListener", address)
+		}
+	} else if s.listener, err = ListenTCP(address); err != nil {
+		return
 	}
+	upgrader.Register("tcp", address, s.listener)
+	s.Trigger(events)
 	return
 }
 
 // 服务停止阶段，关闭每一个网络连接
 func (s *TCPServer) Shutdown(events network.Events) (err error) {
 	if s.listener != nil {
+		address := network.GetTCPAddr(s.Address).String()
+		network.DefaultUpgrader.Unregister("tcp", address)
 		if err = s.listener.Close(); err != nil {
 			return
 		}
@@ -52,18 +76,42 @@ func (s *TCPServer) Run(events network.Events) (err error) {
 	if events.Serving != nil {
 		events.Serving(s.Server)
 	}
+	// 通知父进程可以交接了，升级后不再接入，等待已有连接结束
+	upgrader := network.DefaultUpgrader
+	upgrader.Ready()
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-upgrader.Upgraded():
+			s.listener.SetDeadline(time.Now())
+		case <-stop:
+		}
+	}()
 	// 循环接收和处理连接
-	var conn *net.TCPConn
+	var (
+		conn    *net.TCPConn
+		backoff network.Backoff
+	)
 	for {
 		conn, err = s.listener.AcceptTCP()
 		if err != nil {
+			if upgrader.IsUpgraded() {
+				upgrader.Drain(&s.active)
+				return nil
+			}
 			if network.IsTemporaryError(err) {
+				backoff.Wait()
 				continue
 			}
 			return
 		}
+		backoff.Reset()
 		c := network.NewTCPConn(conn)
-		go s.Execute(events, c)
+		s.active.Add(c)
+		go func() {
+			defer s.active.Done(c)
+			s.Execute(events, c)
+		}()
 	}
-	return
 }
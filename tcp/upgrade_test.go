@@ -0,0 +1,162 @@
+// +build android darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package tcp
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/azhai/gozzo-net/network"
+)
+
+// 设置了这个环境变量时，测试程序作为被升级的服务进程运行
+const upgradeTestEnv = "GOZZO_UPGRADE_TEST_ADDR"
+
+func TestMain(m *testing.M) {
+	if address := os.Getenv(upgradeTestEnv); address != "" {
+		runUpgradeServer(address)
+		os.Exit(0)
+	}
+	if address := os.Getenv(activationTestEnv); address != "" {
+		runActivatedServer(address)
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// 回应本进程的pid，收到SIGUSR2时升级
+func runUpgradeServer(address string) {
+	addr, err := net.ResolveTCPAddr("tcp", address)
+	if err != nil {
+		os.Exit(1)
+	}
+	server := NewServer(network.NewAddrServer(addr))
+	events := network.Events{
+		Prepare: func(c *network.Conn) (bufio.SplitFunc, network.FilterFunc) {
+			return bufio.ScanLines, nil
+		},
+		Receive: func(c *network.Conn, data []byte, saved bool) (string, error) {
+			time.Sleep(20 * time.Millisecond) // 让升级时有未完成的连接
+			return "", c.QuickSend([]byte(fmt.Sprintf("%d\n", os.Getpid())))
+		},
+	}
+	network.DefaultUpgrader.WatchSignal()
+	if err = server.Run(events); err != nil {
+		os.Exit(1)
+	}
+}
+
+func freePort(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func askPid(address string) (int, error) {
+	conn, err := net.DialTimeout("tcp", address, time.Second)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	if _, err = conn.Write([]byte("pid\n")); err != nil {
+		return 0, err
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(line))
+}
+
+func TestUpgradeUnderLoad(t *testing.T) {
+	address := freePort(t)
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	cmd.Env = append(os.Environ(), upgradeTestEnv+"="+address)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := askPid(address); err == nil {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// 持续请求，升级前后都不能出错
+	var (
+		wg    sync.WaitGroup
+		mutex sync.Mutex
+		pids  = make(map[int]int)
+		errs  []error
+		stop  = make(chan struct{})
+	)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				pid, err := askPid(address)
+				mutex.Lock()
+				if err != nil {
+					errs = append(errs, err)
+				} else {
+					pids[pid]++
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+	time.Sleep(200 * time.Millisecond)
+	if err := cmd.Process.Signal(syscall.SIGUSR2); err != nil {
+		t.Fatal(err)
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	select {
+	case err := <-exited:
+		if err != nil {
+			t.Errorf("old process: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Error("old process did not exit after upgrade")
+	}
+	time.Sleep(200 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+
+	for pid := range pids {
+		if pid != cmd.Process.Pid {
+			if proc, err := os.FindProcess(pid); err == nil {
+				proc.Kill()
+			}
+		}
+	}
+	if len(errs) > 0 {
+		t.Fatalf("%d requests failed, first: %v", len(errs), errs[0])
+	}
+	if pids[cmd.Process.Pid] == 0 || len(pids) != 2 {
+		t.Fatalf("expected answers from old and new process, got %v", pids)
+	}
+}
@@ -0,0 +1,67 @@
+package udp
+
+import (
+	"net"
+)
+
+// 默认每批收发的数据包个数
+const DefaultBatchSize = 64
+
+// 批量收发的单个数据包
+type Message struct {
+	Buffer []byte       // 读取时为缓冲区，写入时为数据
+	N      int          // 实际读取或写入的字节数
+	Addr   *net.UDPAddr // 对端地址，已连接的socket写入时可为空
+}
+
+// 批量收发数据包
+type BatchConn interface {
+	ReadBatch(ms []Message) (int, error)
+	WriteBatch(ms []Message) (int, error)
+}
+
+// 逐个收发的通用实现
+type packetConn struct {
+	conn *net.UDPConn
+}
+
+func newPacketConn(conn *net.UDPConn) *packetConn {
+	return &packetConn{conn: conn}
+}
+
+// 每次只读一个数据包
+func (pc *packetConn) ReadBatch(ms []Message) (int, error) {
+	if len(ms) == 0 {
+		return 0, nil
+	}
+	n, addr, err := pc.conn.ReadFromUDP(ms[0].Buffer)
+	if err != nil {
+		return 0, err
+	}
+	ms[0].N, ms[0].Addr = n, addr
+	return 1, nil
+}
+
+// 逐个写入，返回成功写入的个数
+func (pc *packetConn) WriteBatch(ms []Message) (i int, err error) {
+	for i = 0; i < len(ms); i++ {
+		if ms[i].Addr == nil {
+			ms[i].N, err = pc.conn.Write(ms[i].Buffer)
+		} else {
+			ms[i].N, err = pc.conn.WriteToUDP(ms[i].Buffer, ms[i].Addr)
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// 创建缓冲区，用于批量读取
+func NewMessages(size, bufsize int) []Message {
+	ms := make([]Message, size)
+	for i := range ms {
+		ms[i].Buffer = make([]byte, bufsize)
+	}
+	return ms
+}
@@ -0,0 +1,188 @@
+// +build linux,amd64 linux,arm64
+
+package udp
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// 内核中的struct mmsghdr
+type mmsghdr struct {
+	Hdr syscall.Msghdr
+	Len uint32
+}
+
+// 使用recvmmsg/sendmmsg批量收发，一次系统调用处理多个数据包
+type mmsgConn struct {
+	raw   syscall.RawConn
+	inet6 bool // socket是否为IPv6（含双栈）
+	hdrs  []mmsghdr
+	iovs  []syscall.Iovec
+	names []syscall.RawSockaddrAny
+}
+
+// 创建批量收发的连接，Linux下使用recvmmsg/sendmmsg
+func NewBatchConn(conn *net.UDPConn) BatchConn {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return newPacketConn(conn)
+	}
+	bc := &mmsgConn{raw: raw}
+	err = raw.Control(func(fd uintptr) {
+		if sa, err := syscall.Getsockname(int(fd)); err == nil {
+			_, bc.inet6 = sa.(*syscall.SockaddrInet6)
+		}
+	})
+	if err != nil {
+		return newPacketConn(conn)
+	}
+	return bc
+}
+
+// 按消息个数准备mmsghdr，重复使用上一次的内存
+func (bc *mmsgConn) prepare(size int) {
+	if cap(bc.hdrs) < size {
+		bc.hdrs = make([]mmsghdr, size)
+		bc.iovs = make([]syscall.Iovec, size)
+		bc.names = make([]syscall.RawSockaddrAny, size)
+	}
+	bc.hdrs, bc.iovs = bc.hdrs[:size], bc.iovs[:size]
+	bc.names = bc.names[:size]
+	for i := range bc.hdrs {
+		bc.hdrs[i] = mmsghdr{}
+	}
+}
+
+func (bc *mmsgConn) setBuffer(i int, buf []byte) {
+	bc.iovs[i] = syscall.Iovec{}
+	if len(buf) > 0 {
+		bc.iovs[i].Base = &buf[0]
+		bc.iovs[i].SetLen(len(buf))
+	}
+	bc.hdrs[i].Hdr.Iov = &bc.iovs[i]
+	bc.hdrs[i].Hdr.Iovlen = 1
+}
+
+func (bc *mmsgConn) ReadBatch(ms []Message) (n int, err error) {
+	if len(ms) == 0 {
+		return 0, nil
+	}
+	bc.prepare(len(ms))
+	for i := range ms {
+		bc.setBuffer(i, ms[i].Buffer)
+		bc.hdrs[i].Hdr.Name = (*byte)(unsafe.Pointer(&bc.names[i]))
+		bc.hdrs[i].Hdr.Namelen = syscall.SizeofSockaddrAny
+	}
+	if n, err = bc.mmsg(sysRECVMMSG, bc.hdrs); err != nil {
+		return 0, err
+	}
+	for i := 0; i < n; i++ {
+		ms[i].N = int(bc.hdrs[i].Len)
+		ms[i].Addr = decodeSockaddr(&bc.names[i])
+	}
+	return
+}
+
+func (bc *mmsgConn) WriteBatch(ms []Message) (n int, err error) {
+	if len(ms) == 0 {
+		return 0, nil
+	}
+	bc.prepare(len(ms))
+	for i := range ms {
+		bc.setBuffer(i, ms[i].Buffer)
+		if ms[i].Addr != nil {
+			size := encodeSockaddr(&bc.names[i], ms[i].Addr, bc.inet6)
+			bc.hdrs[i].Hdr.Name = (*byte)(unsafe.Pointer(&bc.names[i]))
+			bc.hdrs[i].Hdr.Namelen = size
+		}
+	}
+	for n < len(ms) { // sendmmsg可能只发送了一部分
+		var sent int
+		if sent, err = bc.mmsg(sysSENDMMSG, bc.hdrs[n:]); err != nil {
+			break
+		}
+		for i := n; i < n+sent; i++ {
+			ms[i].N = int(bc.hdrs[i].Len)
+		}
+		n += sent
+	}
+	return
+}
+
+// 执行系统调用，未就绪时交给Go的网络轮询器等待
+func (bc *mmsgConn) mmsg(trap uintptr, hdrs []mmsghdr) (n int, err error) {
+	var errno syscall.Errno
+	op := func(fd uintptr) bool {
+		for {
+			r, _, e := syscall.Syscall6(trap, fd, uintptr(unsafe.Pointer(&hdrs[0])),
+				uintptr(len(hdrs)), 0, 0, 0)
+			if e == syscall.EINTR {
+				continue
+			}
+			if e == syscall.EAGAIN {
+				return false
+			}
+			n, errno = int(r), e
+			return true
+		}
+	}
+	if trap == sysSENDMMSG {
+		err = bc.raw.Write(op)
+	} else {
+		err = bc.raw.Read(op)
+	}
+	if err == nil && errno != 0 {
+		err = errno
+	}
+	return
+}
+
+// 将内核返回的地址转为UDP地址
+func decodeSockaddr(rsa *syscall.RawSockaddrAny) *net.UDPAddr {
+	switch rsa.Addr.Family {
+	case syscall.AF_INET:
+		sa := (*syscall.RawSockaddrInet4)(unsafe.Pointer(rsa))
+		p := (*[2]byte)(unsafe.Pointer(&sa.Port))
+		ip := net.IPv4(sa.Addr[0], sa.Addr[1], sa.Addr[2], sa.Addr[3])
+		return &net.UDPAddr{IP: ip, Port: int(p[0])<<8 | int(p[1])}
+	case syscall.AF_INET6:
+		sa := (*syscall.RawSockaddrInet6)(unsafe.Pointer(rsa))
+		p := (*[2]byte)(unsafe.Pointer(&sa.Port))
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, sa.Addr[:])
+		addr := &net.UDPAddr{IP: ip, Port: int(p[0])<<8 | int(p[1])}
+		if sa.Scope_id > 0 {
+			if ifi, err := net.InterfaceByIndex(int(sa.Scope_id)); err == nil {
+				addr.Zone = ifi.Name
+			}
+		}
+		return addr
+	}
+	return nil
+}
+
+// 将UDP地址写入rsa，IPv6的socket使用映射地址发往IPv4
+func encodeSockaddr(rsa *syscall.RawSockaddrAny, addr *net.UDPAddr, inet6 bool) uint32 {
+	*rsa = syscall.RawSockaddrAny{}
+	if ip4 := addr.IP.To4(); ip4 != nil && !inet6 {
+		sa := (*syscall.RawSockaddrInet4)(unsafe.Pointer(rsa))
+		sa.Family = syscall.AF_INET
+		p := (*[2]byte)(unsafe.Pointer(&sa.Port))
+		p[0], p[1] = byte(addr.Port>>8), byte(addr.Port)
+		copy(sa.Addr[:], ip4)
+		return syscall.SizeofSockaddrInet4
+	}
+	sa := (*syscall.RawSockaddrInet6)(unsafe.Pointer(rsa))
+	sa.Family = syscall.AF_INET6
+	p := (*[2]byte)(unsafe.Pointer(&sa.Port))
+	p[0], p[1] = byte(addr.Port>>8), byte(addr.Port)
+	copy(sa.Addr[:], addr.IP.To16())
+	if addr.Zone != "" {
+		if ifi, err := net.InterfaceByName(addr.Zone); err == nil {
+			sa.Scope_id = uint32(ifi.Index)
+		}
+	}
+	return syscall.SizeofSockaddrInet6
+}
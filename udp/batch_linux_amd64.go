@@ -0,0 +1,8 @@
+// +build linux,amd64
+
+package udp
+
+const (
+	sysRECVMMSG = 299
+	sysSENDMMSG = 307
+)
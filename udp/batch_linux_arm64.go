@@ -0,0 +1,8 @@
+// +build linux,arm64
+
+package udp
+
+const (
+	sysRECVMMSG = 243
+	sysSENDMMSG = 269
+)
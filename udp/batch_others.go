@@ -0,0 +1,12 @@
+// +build !linux !amd64,!arm64
+
+package udp
+
+import (
+	"net"
+)
+
+// 创建批量收发的连接，非Linux平台逐个收发
+func NewBatchConn(conn *net.UDPConn) BatchConn {
+	return newPacketConn(conn)
+}
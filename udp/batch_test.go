@@ -0,0 +1,174 @@
+package udp
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/azhai/gozzo-net/network"
+)
+
+const benchPacketSize = 128
+
+func listenLoopback(t testing.TB) *net.UDPConn {
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadBuffer(4 << 20)
+	return conn
+}
+
+func TestBatchConn(t *testing.T) {
+	recv, send := listenLoopback(t), listenLoopback(t)
+	defer recv.Close()
+	defer send.Close()
+
+	dest := recv.LocalAddr().(*net.UDPAddr)
+	ms := make([]Message, 10)
+	for i := range ms {
+		ms[i] = Message{Buffer: []byte(fmt.Sprintf("packet-%d", i)), Addr: dest}
+	}
+	n, err := NewBatchConn(send).WriteBatch(ms)
+	if err != nil || n != len(ms) {
+		t.Fatalf("WriteBatch: n=%d err=%v", n, err)
+	}
+
+	recv.SetReadDeadline(time.Now().Add(2 * time.Second))
+	bc, got := NewBatchConn(recv), NewMessages(4, MaxDatagramSize)
+	for i := 0; i < len(ms); {
+		n, err = bc.ReadBatch(got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < n; j, i = j+1, i+1 {
+			data := got[j].Buffer[:got[j].N]
+			if !bytes.Equal(data, ms[i].Buffer) {
+				t.Fatalf("packet %d: %q != %q", i, data, ms[i].Buffer)
+			}
+			if got[j].Addr.String() != send.LocalAddr().String() {
+				t.Fatalf("packet %d from %s", i, got[j].Addr)
+			}
+		}
+	}
+}
+
+// 客户端连接时准备好批量发送，之后每次SendBatch都复用
+func TestClientSendBatch(t *testing.T) {
+	recv := listenLoopback(t)
+	defer recv.Close()
+	client := NewClient(network.NewDialPlan(recv.LocalAddr(), nil, 0), network.Options{})
+	if _, err := network.Reconnect(client, false, 1); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	bc := client.batch
+	if bc == nil {
+		t.Fatal("no batch conn after connecting")
+	}
+	for round := 0; round < 2; round++ {
+		if n, err := client.SendBatch([][]byte{[]byte("a"), []byte("b")}); n != 2 || err != nil {
+			t.Fatalf("SendBatch: n=%d err=%v", n, err)
+		}
+		if client.batch != bc {
+			t.Fatal("the batch conn was rebuilt")
+		}
+	}
+	recv.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 16)
+	for i := 0; i < 4; i++ {
+		if _, err := recv.Read(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// 持续发送数据包，直到stop被关闭
+func flood(conn *net.UDPConn, dest *net.UDPAddr, stop chan struct{}) {
+	ms := make([]Message, DefaultBatchSize)
+	for i := range ms {
+		ms[i] = Message{Buffer: make([]byte, benchPacketSize), Addr: dest}
+	}
+	bc := NewBatchConn(conn)
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+			bc.WriteBatch(ms)
+		}
+	}
+}
+
+func benchmarkRead(b *testing.B, batch bool) {
+	recv, send := listenLoopback(b), listenLoopback(b)
+	defer recv.Close()
+	defer send.Close()
+	stop := make(chan struct{})
+	defer close(stop)
+	go flood(send, recv.LocalAddr().(*net.UDPAddr), stop)
+
+	b.SetBytes(benchPacketSize)
+	b.ResetTimer()
+	recv.SetReadDeadline(time.Now().Add(time.Minute))
+	var bc BatchConn = newPacketConn(recv)
+	if batch {
+		bc = NewBatchConn(recv)
+	}
+	ms := NewMessages(DefaultBatchSize, MaxDatagramSize)
+	for i := 0; i < b.N; {
+		n, err := bc.ReadBatch(ms)
+		if err != nil {
+			b.Fatal(err)
+		}
+		i += n
+	}
+}
+
+func benchmarkWrite(b *testing.B, batch bool) {
+	recv, send := listenLoopback(b), listenLoopback(b)
+	defer recv.Close()
+	defer send.Close()
+
+	dest := recv.LocalAddr().(*net.UDPAddr)
+	ms := make([]Message, DefaultBatchSize)
+	for i := range ms {
+		ms[i] = Message{Buffer: make([]byte, benchPacketSize), Addr: dest}
+	}
+	var bc BatchConn = newPacketConn(send)
+	if batch {
+		bc = NewBatchConn(send)
+	}
+	b.SetBytes(benchPacketSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; {
+		size := b.N - i
+		if size > len(ms) {
+			size = len(ms)
+		}
+		n, err := bc.WriteBatch(ms[:size])
+		if err != nil {
+			b.Fatal(err)
+		}
+		i += n
+	}
+}
+
+func BenchmarkReadPerPacket(b *testing.B) {
+	benchmarkRead(b, false)
+}
+
+func BenchmarkReadBatch(b *testing.B) {
+	benchmarkRead(b, true)
+}
+
+func BenchmarkWritePerPacket(b *testing.B) {
+	benchmarkWrite(b, false)
+}
+
+func BenchmarkWriteBatch(b *testing.B) {
+	benchmarkWrite(b, true)
+}
@@ -1,14 +1,20 @@
 package udp
 
 import (
+	"fmt"
+	"net"
+
 	"github.com/azhai/gozzo-net/network"
 )
 
 // UDP 客户端
 type UDPClient struct {
-	options  network.Options
-	dialplan *network.DialPlan
-	Conn     *network.Conn
+	options   network.Options
+	dialplan  *network.DialPlan
+	Conn      *network.Conn
+	Multicast *network.Multicast // 发往组播地址时，设置TTL、回环和网卡
+	batch     BatchConn          // SendBatch使用，连接更换时重建
+	batchFor  *network.Conn
 }
 
 // 创建UDP客户端
@@ -31,15 +37,54 @@ func (c *UDPClient) GetConn() *network.Conn {
 	return c.Conn
 }
 
+// 设置连接，同时准备好批量发送
 func (c *UDPClient) SetConn(conn *network.Conn) {
 	c.Conn = conn
+	c.batchConn()
+}
+
+// 当前连接的批量发送，每个连接只创建一次
+func (c *UDPClient) batchConn() BatchConn {
+	if c.batchFor == c.Conn {
+		return c.batch
+	}
+	c.batch, c.batchFor = nil, c.Conn
+	if c.Conn != nil {
+		if conn, ok := c.Conn.GetRawConn().(*net.UDPConn); ok {
+			c.batch = NewBatchConn(conn)
+		}
+	}
+	return c.batch
 }
 
 func (c *UDPClient) Dialing() (*network.Conn, error) {
 	conn, err := c.dialplan.DialUDP()
 	if err == nil && conn != nil {
+		nc := network.NewUDPConn(conn)
 		err = c.options.ApplyConn(conn)
-		return network.NewUDPConn(conn), err
+		if err == nil {
+			err = c.options.ApplyDeadline(nc)
+		}
+		if err == nil && c.Multicast != nil {
+			err = c.Multicast.ApplySender(conn)
+		}
+		return nc, err
 	}
 	return nil, err
 }
+
+// 批量发送数据包，Linux下使用sendmmsg，返回成功发送的个数
+func (c *UDPClient) SendBatch(datas [][]byte) (int, error) {
+	if c.Conn == nil || c.Conn.IsActive == false {
+		return 0, fmt.Errorf("Lost connection")
+	}
+	bc := c.batchConn()
+	if bc == nil {
+		return 0, fmt.Errorf("The connection is not a UDPConn object")
+	}
+	ms := make([]Message, len(datas))
+	for i, data := range datas {
+		ms[i].Buffer = data
+	}
+	return bc.WriteBatch(ms)
+}
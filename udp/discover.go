@@ -0,0 +1,255 @@
+package udp
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/azhai/gozzo-net/network"
+)
+
+// 服务发现的默认端口
+const DefaultDiscoverPort = 47900
+
+// 探测和回应的开头标记
+var (
+	ProbeToken   = []byte("GOZZO-DISCOVER\n")
+	ServiceToken = []byte("GOZZO-SERVICE\n")
+)
+
+// 局域网服务发现的应答方，与network.Server一同运行
+type Responder struct {
+	conn    *net.UDPConn
+	Name    string   // 服务名称，探测时可按名称过滤
+	Kind    string   // 服务的网络类型，tcp或udp
+	Port    int      // 监听探测的端口
+	Address net.Addr // 服务监听的地址
+}
+
+// 创建应答方，回应server的监听地址
+func NewResponder(server *network.Server, name string) *Responder {
+	return &Responder{
+		Name:    name,
+		Kind:    "tcp",
+		Port:    DefaultDiscoverPort,
+		Address: server.Address,
+	}
+}
+
+// 服务的所有地址，监听通配地址时使用全部局域网IP
+func (r *Responder) GetAddrs() (addrs []string) {
+	host, port, err := net.SplitHostPort(r.Address.String())
+	if err != nil {
+		return
+	}
+	if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() {
+		return []string{r.Address.String()}
+	}
+	for _, ipnet := range network.GetLocalAddrs() {
+		addrs = append(addrs, net.JoinHostPort(ipnet.IP.String(), port))
+	}
+	return
+}
+
+// 生成回应的内容
+func (r *Responder) Reply() []byte {
+	buf := bytes.NewBuffer(append([]byte(nil), ServiceToken...))
+	fmt.Fprintf(buf, "%s\n%s\n", r.Name, r.Kind)
+	for _, addr := range r.GetAddrs() {
+		fmt.Fprintf(buf, "%s\n", addr)
+	}
+	return buf.Bytes()
+}
+
+// 监听探测的端口，在Run()之前调用可以确保Run()返回前已经开始监听
+func (r *Responder) Listen() (err error) {
+	if r.conn != nil {
+		return
+	}
+	addr := &net.UDPAddr{IP: net.IPv4zero, Port: r.Port}
+	r.conn, err = net.ListenUDP("udp4", addr)
+	return
+}
+
+// 开始应答，直到Close()
+func (r *Responder) Run() (err error) {
+	if err = r.Listen(); err != nil {
+		return
+	}
+	var (
+		n     int
+		raddr *net.UDPAddr
+		buf   = make([]byte, 1024)
+	)
+	for {
+		n, raddr, err = r.conn.ReadFromUDP(buf)
+		if err != nil {
+			if network.IsTemporaryError(err) {
+				continue
+			}
+			return
+		}
+		if name, ok := ParseProbe(buf[:n]); ok && (name == "" || name == r.Name) {
+			r.conn.WriteToUDP(r.Reply(), raddr)
+		}
+	}
+}
+
+func (r *Responder) Close() error {
+	if r.conn == nil {
+		return nil
+	}
+	return r.conn.Close()
+}
+
+// 解析探测包，返回要找的服务名称
+func ParseProbe(data []byte) (string, bool) {
+	if !bytes.HasPrefix(data, ProbeToken) {
+		return "", false
+	}
+	name := data[len(ProbeToken):]
+	return strings.TrimSpace(string(name)), true
+}
+
+// 发现的服务
+type Service struct {
+	Name  string
+	Kind  string
+	Addrs []string
+	From  *net.UDPAddr // 应答方的地址
+}
+
+// 解析回应包
+func ParseService(data []byte) (*Service, bool) {
+	if !bytes.HasPrefix(data, ServiceToken) {
+		return nil, false
+	}
+	lines := strings.Split(string(data[len(ServiceToken):]), "\n")
+	if len(lines) < 2 {
+		return nil, false
+	}
+	srv := &Service{Name: lines[0], Kind: lines[1]}
+	for _, line := range lines[2:] {
+		if line = strings.TrimSpace(line); line != "" {
+			srv.Addrs = append(srv.Addrs, line)
+		}
+	}
+	return srv, true
+}
+
+// 选择一个地址，优先使用与本机在同一网段的
+func (s *Service) GetAddr() (addr net.Addr) {
+	var addrs []net.Addr
+	for _, address := range s.Addrs {
+		var err error
+		if s.Kind == "udp" {
+			addr, err = net.ResolveUDPAddr("udp", address)
+		} else {
+			addr, err = net.ResolveTCPAddr("tcp", address)
+		}
+		if err == nil {
+			addrs = append(addrs, addr)
+		}
+	}
+	if len(addrs) == 0 {
+		return nil
+	}
+	for _, ipnet := range network.GetLocalAddrs() {
+		for _, addr := range addrs {
+			host, _, _ := net.SplitHostPort(addr.String())
+			if ipnet.Contains(net.ParseIP(host)) {
+				return addr
+			}
+		}
+	}
+	return addrs[0]
+}
+
+// 创建连接到此服务的拨号计划
+func (s *Service) GetDialPlan(timeout int) *network.DialPlan {
+	if addr := s.GetAddr(); addr != nil {
+		return network.NewDialPlan(addr, nil, timeout)
+	}
+	return nil
+}
+
+// 服务发现的探测方
+type Prober struct {
+	Name    string         // 只找这个名称的服务，为空时不限
+	Port    int            // 应答方的端口
+	Targets []*net.UDPAddr // 探测包的目标，为空时广播到所有局域网
+}
+
+// 广播地址，包括每个局域网网段的广播地址
+func (p *Prober) GetTargets() []*net.UDPAddr {
+	if len(p.Targets) > 0 {
+		return p.Targets
+	}
+	targets := []*net.UDPAddr{{IP: net.IPv4bcast, Port: p.Port}}
+	for _, ipnet := range network.GetLocalAddrs() {
+		ip, mask := ipnet.IP.To4(), ipnet.Mask
+		if len(mask) == net.IPv6len {
+			mask = mask[12:]
+		}
+		bcast := make(net.IP, net.IPv4len)
+		for i := range bcast {
+			bcast[i] = ip[i] | ^mask[i]
+		}
+		targets = append(targets, &net.UDPAddr{IP: bcast, Port: p.Port})
+	}
+	return targets
+}
+
+// 发出探测，在timeout时间内收集所有回应
+func (p *Prober) Discover(timeout time.Duration) (result []*Service, err error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	probe := append(append([]byte(nil), ProbeToken...), p.Name...)
+	sent := 0
+	for _, target := range p.GetTargets() {
+		if _, err = conn.WriteToUDP(probe, target); err == nil {
+			sent++
+		}
+	}
+	if sent == 0 {
+		return
+	}
+	err = nil
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	var (
+		n     int
+		raddr *net.UDPAddr
+		buf   = make([]byte, MaxDatagramSize)
+		seen  = make(map[string]bool)
+	)
+	for {
+		n, raddr, err = conn.ReadFromUDP(buf)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				err = nil // 时间到，正常结束
+			}
+			return
+		}
+		srv, ok := ParseService(buf[:n])
+		if !ok || seen[raddr.String()] {
+			continue
+		}
+		if p.Name != "" && srv.Name != p.Name {
+			continue
+		}
+		seen[raddr.String()] = true
+		srv.From = raddr
+		result = append(result, srv)
+	}
+}
+
+// 在局域网内广播探测，返回所有回应的服务
+func Discover(timeout time.Duration) ([]*Service, error) {
+	p := &Prober{Port: DefaultDiscoverPort}
+	return p.Discover(timeout)
+}
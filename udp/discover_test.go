@@ -0,0 +1,52 @@
+package udp
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/azhai/gozzo-net/network"
+)
+
+// 空闲的UDP端口
+func freeUDPPort(t *testing.T) int {
+	conn := listenLoopback(t)
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// 向回环地址单播探测，不依赖广播能否送达
+func TestDiscover(t *testing.T) {
+	server := network.NewPortServer("127.0.0.1", 47901)
+	r := NewResponder(server, "test")
+	r.Port = freeUDPPort(t)
+	if err := r.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	go r.Run()
+	defer r.Close()
+
+	target := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: r.Port}
+	p := &Prober{Name: "test", Port: r.Port, Targets: []*net.UDPAddr{target}}
+	services, err := p.Discover(500 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 1 {
+		t.Fatalf("found %d services", len(services))
+	}
+	srv := services[0]
+	if srv.Name != "test" || srv.Kind != "tcp" {
+		t.Fatalf("found %s %s", srv.Name, srv.Kind)
+	}
+	plan := srv.GetDialPlan(3)
+	if plan == nil || plan.RemoteAddr.String() != "127.0.0.1:47901" {
+		t.Fatalf("dial plan for %v", srv.Addrs)
+	}
+
+	// 名称不同的服务不回应
+	p.Name = "other"
+	if services, err := p.Discover(100 * time.Millisecond); err != nil || len(services) != 0 {
+		t.Fatalf("found %d services, %v", len(services), err)
+	}
+}
@@ -0,0 +1,103 @@
+package udp
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/azhai/gozzo-net/network"
+)
+
+// 找到回环网卡，不支持组播时跳过测试
+func loopbackMulticast(t *testing.T, groups ...string) *network.Multicast {
+	m := network.NewMulticast(groups...)
+	if err := m.AddInterface(net.IPv4(127, 0, 0, 1)); err != nil {
+		t.Skip(err)
+	}
+	m.Loopback = true
+	return m
+}
+
+func TestMulticastJoin(t *testing.T) {
+	m := loopbackMulticast(t, "239.255.77.1", "239.255.77.2")
+	addr := &net.UDPAddr{IP: net.IPv4zero, Port: 0}
+	conn, err := network.ListenMulticast(addr, m)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer conn.Close()
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+
+	for _, group := range m.Groups {
+		plan := network.NewDialPlan(&net.UDPAddr{IP: group, Port: port}, nil, 0)
+		client := NewClient(plan, network.Options{})
+		client.Multicast = m
+		if _, err = network.Reconnect(client, false, 1); err != nil {
+			t.Fatal(err)
+		}
+		if err = network.SendData(client, []byte(group.String())); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 64)
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != group.String() {
+			t.Fatalf("got %q from group %s", buf[:n], group)
+		}
+		client.Close()
+	}
+}
+
+func TestMulticastServer(t *testing.T) {
+	group := net.IPv4(239, 255, 77, 3)
+	m := loopbackMulticast(t)
+	server := NewServer(network.NewAddrServer(&net.UDPAddr{IP: group, Port: 0}))
+	server.Multicast = m
+	received := make(chan string, 1)
+	events := network.Events{
+		Serving: func(s *network.Server) {
+			received <- "serving"
+		},
+		Prepare: func(c *network.Conn) (bufio.SplitFunc, network.FilterFunc) {
+			return bufio.ScanLines, nil
+		},
+		Receive: func(c *network.Conn, data []byte, saved bool) (string, error) {
+			received <- string(data)
+			return "", nil
+		},
+	}
+	go server.Run(events)
+	defer server.Shutdown(events)
+	<-received
+
+	port := server.GetConn().LocalAddr().(*net.UDPAddr).Port // 监听时由系统分配
+	plan := network.NewDialPlan(&net.UDPAddr{IP: group, Port: port}, nil, 0)
+	client := NewClient(plan, network.Options{})
+	client.Multicast = m
+	defer client.Close()
+	if _, err := network.TrySendData(client, []byte("hello\n"), 1); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case data := <-received:
+		if data != "hello" {
+			t.Fatalf("got %q", data)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no multicast received")
+	}
+}
+
+// IPv4和IPv6的组播不能加入同一个socket，监听前就报错
+func TestMulticastMixedGroups(t *testing.T) {
+	m := network.NewMulticast("239.255.77.1", "ff02::1:3")
+	conn, err := network.ListenMulticast(&net.UDPAddr{Port: 0}, m)
+	if err == nil {
+		conn.Close()
+		t.Fatal("mixed groups were accepted")
+	}
+}
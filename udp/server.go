@@ -3,35 +3,104 @@ package udp
 import (
 	"net"
 	"runtime"
+	"sync"
+	"time"
 
 	"github.com/azhai/gozzo-net/network"
 )
 
-// UDP服务器
+// 单个数据包最大长度
+const MaxDatagramSize = 65535
+
+// 对端默认的空闲超时
+var DefaultIdleTimeout = 60 * time.Second
+
+// UDP服务器，为每个对端地址创建一个虚拟连接
 type UDPServer struct {
+	conn        *net.UDPConn
+	peers       *network.PeerTable
+	stop        chan struct{}
+	stopOnce    sync.Once
+	Options     network.Options
+	IdleTimeout time.Duration
+	MaxPeers    int                // 大于0时限制对端个数
+	BatchSize   int                // 大于1时批量接收，Linux下使用recvmmsg
+	Multicast   *network.Multicast // 不为空时监听组播
 	*network.Server
 }
 
 // 创建UDP服务器
 func NewServer(server *network.Server) *UDPServer {
-	return &UDPServer{Server: server}
+	return &UDPServer{
+		IdleTimeout: DefaultIdleTimeout,
+		Server:      server,
+	}
+}
+
+// 返回监听的socket
+func (s *UDPServer) GetConn() *net.UDPConn {
+	return s.conn
 }
 
 // 服务启动阶段，执行Tick事件
+// 由systemd socket activation启动时，使用传入的socket
 func (s *UDPServer) Startup(events network.Events) (err error) {
+	addr := network.GetUDPAddr(s.Address)
+	var pc net.PacketConn
+	if pc, err = network.ActivatedPacket("udp", s.ListenName, addr); err != nil {
+		return
+	}
+	if udpConn, ok := pc.(*net.UDPConn); ok {
+		s.conn = udpConn
+		if s.Multicast != nil || addr.IP.IsMulticast() {
+			if err = s.Multicast.ForAddr(addr).Join(s.conn); err != nil {
+				s.conn.Close()
+			}
+		}
+	} else if s.Multicast != nil || addr.IP.IsMulticast() {
+		s.conn, err = network.ListenMulticast(addr, s.Multicast)
+	} else {
+		s.conn, err = net.ListenUDP("udp", addr)
+	}
+	if err != nil {
+		return
+	}
+	if err = s.Options.ApplyConn(s.conn); err != nil { // 监听的socket不设置超时
+		s.conn.Close()
+		return
+	}
+	s.peers = network.NewPeerTable("udp", s.conn)
+	s.peers.MaxPeers = s.MaxPeers
+	s.stop = make(chan struct{})
 	s.Trigger(events)
+	go s.peers.ExpireLoop(s.IdleTimeout, s.stop)
 	return
 }
 
 // 服务停止阶段，关闭每一个网络连接
 func (s *UDPServer) Shutdown(events network.Events) (err error) {
-	s.Cleanup(func(c *network.Conn) error {
-		return s.Finish(events, c)
+	s.stopOnce.Do(func() {
+		if s.stop != nil {
+			close(s.stop)
+		}
+		if s.conn != nil {
+			err = s.conn.Close()
+		}
+		// 会话在自己的goroutine中结束，执行Closed事件
+		if s.peers != nil {
+			s.peers.Close()
+		}
+		s.Cleanup(nil)
 	})
 	return
 }
 
-// 开始服务，接受客户端连接，并进行读写
+// 将数据包交给对应的虚拟连接，新的对端会开始一个会话
+func (s *UDPServer) Dispatch(events network.Events, addr *net.UDPAddr, data []byte) {
+	s.peers.Dispatch(s.Server, events, addr, data)
+}
+
+// 开始服务，接收数据包，并按对端地址分发
 func (s *UDPServer) Run(events network.Events) (err error) {
 	runtime.GOMAXPROCS(runtime.NumCPU())
 	// 启动与停止
@@ -42,18 +111,44 @@ func (s *UDPServer) Run(events network.Events) (err error) {
 	if events.Serving != nil {
 		events.Serving(s.Server)
 	}
-	// 循环接收和处理连接
+	if s.BatchSize > 1 {
+		return s.ServeBatch(events, s.BatchSize)
+	}
+	// 循环接收和分发数据包
 	var (
-		addr = network.GetUDPAddr(s.Address)
-		conn *net.UDPConn
+		n    int
+		addr *net.UDPAddr
+		buf  = make([]byte, MaxDatagramSize)
 	)
 	for {
-		conn, err = net.ListenUDP("udp", addr)
+		n, addr, err = s.conn.ReadFromUDP(buf)
 		if err != nil {
-			continue
+			if network.IsTemporaryError(err) {
+				continue
+			}
+			return
+		}
+		s.Dispatch(events, addr, buf[:n])
+	}
+}
+
+// 批量接收和分发数据包，每次系统调用最多读取size个
+func (s *UDPServer) ServeBatch(events network.Events, size int) (err error) {
+	var (
+		n  int
+		bc = NewBatchConn(s.conn)
+		ms = NewMessages(size, MaxDatagramSize)
+	)
+	for {
+		n, err = bc.ReadBatch(ms)
+		if err != nil {
+			if network.IsTemporaryError(err) {
+				continue
+			}
+			return
+		}
+		for i := 0; i < n; i++ {
+			s.Dispatch(events, ms[i].Addr, ms[i].Buffer[:ms[i].N])
 		}
-		c := network.NewUDPConn(conn)
-		s.Execute(events, c)
 	}
-	return
 }
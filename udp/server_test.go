@@ -0,0 +1,151 @@
+package udp
+
+import (
+	"bufio"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/azhai/gozzo-net/network"
+)
+
+// 按行回显的UDP服务器，返回监听地址，opened和closed记录会话的开始和结束
+func runEchoServer(t *testing.T, setup func(s *UDPServer), opened, closed *int32) (*net.UDPAddr, func()) {
+	server := NewServer(network.NewAddrServer(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}))
+	if setup != nil {
+		setup(server)
+	}
+	ready := make(chan bool)
+	events := network.Events{
+		Serving: func(s *network.Server) { ready <- true },
+		Opened: func(s *network.Server, c *network.Conn) error {
+			atomic.AddInt32(opened, 1)
+			return nil
+		},
+		Closed: func(s *network.Server, c *network.Conn, err error) {
+			atomic.AddInt32(closed, 1)
+		},
+		Prepare: func(c *network.Conn) (bufio.SplitFunc, network.FilterFunc) {
+			return bufio.ScanLines, nil
+		},
+		Receive: func(c *network.Conn, data []byte, saved bool) (string, error) {
+			return "", c.QuickSend(append(data, '\n'))
+		},
+	}
+	done := make(chan bool)
+	go func() {
+		server.Run(events)
+		close(done)
+	}()
+	<-ready
+	stop := func() {
+		server.Shutdown(events) // 与接收循环和会话同时进行
+		<-done
+	}
+	return server.GetConn().LocalAddr().(*net.UDPAddr), stop
+}
+
+func dialEcho(t *testing.T, addr *net.UDPAddr) *net.UDPConn {
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// 发送一行，返回回应，超时返回空串
+func echoLine(conn *net.UDPConn, line string, wait time.Duration) string {
+	conn.Write([]byte(line + "\n"))
+	conn.SetReadDeadline(time.Now().Add(wait))
+	buf := make([]byte, MaxDatagramSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return ""
+	}
+	return string(buf[:n])
+}
+
+func waitCount(count *int32, want int32) bool {
+	for i := 0; i < 300; i++ {
+		if atomic.LoadInt32(count) >= want {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestPeerSessions(t *testing.T) {
+	var opened, closed int32
+	addr, stop := runEchoServer(t, nil, &opened, &closed)
+	defer stop()
+	a, b := dialEcho(t, addr), dialEcho(t, addr)
+	defer a.Close()
+	defer b.Close()
+
+	// 每个对端一个会话，回应只发给自己
+	for i := 0; i < 3; i++ {
+		if got := echoLine(a, "from a", time.Second); got != "from a\n" {
+			t.Fatalf("a got %q", got)
+		}
+		if got := echoLine(b, "from b", time.Second); got != "from b\n" {
+			t.Fatalf("b got %q", got)
+		}
+	}
+	if n := atomic.LoadInt32(&opened); n != 2 {
+		t.Fatalf("%d sessions opened", n)
+	}
+	// 停止时每个会话只执行一次Closed
+	stop()
+	if n := atomic.LoadInt32(&closed); n != 2 {
+		t.Fatalf("%d sessions closed", n)
+	}
+}
+
+func TestMaxPeers(t *testing.T) {
+	var opened, closed int32
+	setup := func(s *UDPServer) { s.MaxPeers = 1 }
+	addr, stop := runEchoServer(t, setup, &opened, &closed)
+	defer stop()
+	a, b := dialEcho(t, addr), dialEcho(t, addr)
+	defer a.Close()
+	defer b.Close()
+
+	if got := echoLine(a, "first", time.Second); got != "first\n" {
+		t.Fatalf("a got %q", got)
+	}
+	// 超出上限的新对端被丢弃，已有的对端不受影响
+	if got := echoLine(b, "second", 100*time.Millisecond); got != "" {
+		t.Fatalf("b got %q", got)
+	}
+	if got := echoLine(a, "again", time.Second); got != "again\n" {
+		t.Fatalf("a got %q", got)
+	}
+	if n := atomic.LoadInt32(&opened); n != 1 {
+		t.Fatalf("%d sessions opened", n)
+	}
+}
+
+func TestPeerIdleExpire(t *testing.T) {
+	var opened, closed int32
+	setup := func(s *UDPServer) { s.IdleTimeout = 100 * time.Millisecond }
+	addr, stop := runEchoServer(t, setup, &opened, &closed)
+	defer stop()
+	a := dialEcho(t, addr)
+	defer a.Close()
+
+	if got := echoLine(a, "hello", time.Second); got != "hello\n" {
+		t.Fatalf("got %q", got)
+	}
+	// 空闲超时后会话结束，再次发送时开始新的会话
+	if !waitCount(&closed, 1) {
+		t.Fatal("idle session was not expired")
+	}
+	if got := echoLine(a, "hello", time.Second); got != "hello\n" {
+		t.Fatalf("got %q", got)
+	}
+	if n := atomic.LoadInt32(&opened); n != 2 {
+		t.Fatalf("%d sessions opened", n)
+	}
+}
@@ -0,0 +1,396 @@
+package unix
+
+import (
+	"bufio"
+	"hash/crc32"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/azhai/gozzo-net/network"
+)
+
+// 后端的统计，后端集合更新时，相同地址的后端共用同一份
+type BackendStats struct {
+	active int64 // 正在转发的连接数
+	total  int64 // 累计分配的连接数
+	health
+}
+
+func (s *BackendStats) Active() int {
+	return int(atomic.LoadInt64(&s.active))
+}
+
+func (s *BackendStats) Total() int {
+	return int(atomic.LoadInt64(&s.total))
+}
+
+// 负载均衡的后端，Weight小于1时按1计算
+type Backend struct {
+	Kind   string
+	Weight int
+	*network.DialPlan
+	*BackendStats
+}
+
+// 创建TCP后端
+func NewBackend(addr net.Addr, weight int) *Backend {
+	dp := network.NewDialPlan(addr, nil, 10)
+	return &Backend{Kind: "tcp", Weight: weight, DialPlan: dp}
+}
+
+// 创建指定类型的后端，kind为tcp、udp或unix
+func NewKindBackend(kind string, addr net.Addr, weight int) *Backend {
+	b := NewBackend(addr, weight)
+	b.Kind = kind
+	return b
+}
+
+func (b *Backend) String() string {
+	return b.Kind + "://" + b.RemoteAddr.String()
+}
+
+func (b *Backend) GetWeight() int {
+	if b.Weight < 1 {
+		return 1
+	}
+	return b.Weight
+}
+
+// 记录连接到后端的客户端，连接关闭时自动减少计数
+func (b *Backend) track(c *network.Conn) {
+	atomic.AddInt64(&b.active, 1)
+	atomic.AddInt64(&b.total, 1)
+	go func() {
+		<-c.Done()
+		atomic.AddInt64(&b.active, -1)
+	}()
+}
+
+// 从后端列表中选择一个，列表不为空
+type Picker interface {
+	Pick(c *network.Conn, backends []*Backend) *Backend
+}
+
+// 负载均衡路由，实现了IRouter接口
+// 后端集合可以在运行中更新，已经建立的转发不受影响
+// 不健康的后端会被跳过，见HealthCheck
+type Balancer struct {
+	backends atomic.Value // []*Backend，每次更新都替换为新的切片
+	usable   atomic.Value // []*Backend，健康的后端
+	mutex    sync.Mutex
+	stop     chan struct{}
+	Health   HealthCheck
+	Picker
+}
+
+func NewBalancer(picker Picker, backends ...*Backend) *Balancer {
+	b := &Balancer{Health: DefaultHealthCheck, Picker: picker}
+	b.backends.Store([]*Backend(nil))
+	b.usable.Store([]*Backend(nil))
+	b.Update(backends...)
+	return b
+}
+
+// 轮询
+func NewRoundRobin(backends ...*Backend) *Balancer {
+	return NewBalancer(new(RoundRobin), backends...)
+}
+
+// 加权轮询
+func NewWeightedRoundRobin(backends ...*Backend) *Balancer {
+	return NewBalancer(NewWeighted(), backends...)
+}
+
+// 最少连接
+func NewLeastConn(backends ...*Backend) *Balancer {
+	return NewBalancer(new(LeastConn), backends...)
+}
+
+// 随机选两个，取连接少的
+func NewTwoChoices(backends ...*Backend) *Balancer {
+	return NewBalancer(new(TwoChoices), backends...)
+}
+
+// 一致性哈希，key为空时按客户端IP
+func NewConsistentHash(key KeyFunc, backends ...*Backend) *Balancer {
+	return NewBalancer(NewHashRing(key), backends...)
+}
+
+// 当前的后端列表，不要修改
+func (b *Balancer) Backends() []*Backend {
+	return b.backends.Load().([]*Backend)
+}
+
+// 替换后端集合，地址相同的后端保留原来的统计
+func (b *Balancer) Update(backends ...*Backend) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	stats := make(map[string]*BackendStats)
+	for _, old := range b.Backends() {
+		stats[old.String()] = old.BackendStats
+	}
+	list := make([]*Backend, 0, len(backends))
+	for _, backend := range backends {
+		if s, ok := stats[backend.String()]; ok {
+			backend.BackendStats = s
+		} else if backend.BackendStats == nil {
+			backend.BackendStats = new(BackendStats)
+		}
+		list = append(list, backend)
+	}
+	b.backends.Store(list)
+	var usable []*Backend
+	for _, backend := range list {
+		if backend.IsHealthy() {
+			usable = append(usable, backend)
+		}
+	}
+	b.usable.Store(usable)
+}
+
+// 增加后端，地址已存在时替换
+func (b *Balancer) Add(backend *Backend) {
+	list := b.Backends()
+	backends := make([]*Backend, 0, len(list)+1)
+	for _, old := range list {
+		if old.String() != backend.String() {
+			backends = append(backends, old)
+		}
+	}
+	b.Update(append(backends, backend)...)
+}
+
+// 删除后端
+func (b *Balancer) Remove(backend *Backend) {
+	var backends []*Backend
+	for _, old := range b.Backends() {
+		if old.String() != backend.String() {
+			backends = append(backends, old)
+		}
+	}
+	b.Update(backends...)
+}
+
+func (b *Balancer) Dispatch(c *network.Conn) (string, *network.DialPlan) {
+	backends := b.Usable()
+	if len(backends) == 0 {
+		return "", nil
+	}
+	backend := b.Pick(c, backends)
+	if backend == nil {
+		return "", nil
+	}
+	return backend.Kind, backend.DialPlan
+}
+
+// 连接后端成功，计入后端的连接数，失败的尝试不计入
+func (b *Balancer) Track(c *network.Conn, dp *network.DialPlan) {
+	if backend := b.findBackend(dp); backend != nil {
+		backend.track(c)
+	}
+}
+
+// 轮询
+type RoundRobin struct {
+	next uint64
+}
+
+func (p *RoundRobin) Pick(c *network.Conn, backends []*Backend) *Backend {
+	n := atomic.AddUint64(&p.next, 1) - 1
+	return backends[n%uint64(len(backends))]
+}
+
+// 平滑加权轮询，与nginx的算法相同
+type Weighted struct {
+	current map[*BackendStats]int
+	mutex   sync.Mutex
+}
+
+func NewWeighted() *Weighted {
+	return &Weighted{current: make(map[*BackendStats]int)}
+}
+
+func (p *Weighted) Pick(c *network.Conn, backends []*Backend) *Backend {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	var (
+		best  *Backend
+		total int
+	)
+	current := make(map[*BackendStats]int, len(backends)) // 丢掉已删除的后端
+	for _, b := range backends {
+		weight := b.GetWeight()
+		total += weight
+		current[b.BackendStats] = p.current[b.BackendStats] + weight
+		if best == nil || current[b.BackendStats] > current[best.BackendStats] {
+			best = b
+		}
+	}
+	current[best.BackendStats] -= total
+	p.current = current
+	return best
+}
+
+// 最少连接，连接数相同时轮流
+type LeastConn struct {
+	next uint64
+}
+
+func (p *LeastConn) Pick(c *network.Conn, backends []*Backend) *Backend {
+	size := uint64(len(backends))
+	start := atomic.AddUint64(&p.next, 1) - 1
+	var best *Backend
+	for i := uint64(0); i < size; i++ {
+		b := backends[(start+i)%size]
+		if best == nil || b.Active() < best.Active() {
+			best = b
+		}
+	}
+	return best
+}
+
+// 随机选两个，取连接少的
+type TwoChoices struct{}
+
+func (p *TwoChoices) Pick(c *network.Conn, backends []*Backend) *Backend {
+	size := len(backends)
+	if size == 1 {
+		return backends[0]
+	}
+	i := rand.Intn(size)
+	j := rand.Intn(size - 1)
+	if j >= i {
+		j++
+	}
+	if backends[j].Active() < backends[i].Active() {
+		return backends[j]
+	}
+	return backends[i]
+}
+
+// 从连接中取得哈希的key
+type KeyFunc func(c *network.Conn) string
+
+// 客户端IP
+func ClientIP(c *network.Conn) string {
+	addr := c.GetRemoteAddr()
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// 等待第一帧的时间
+var DefaultPeekTimeout = 3 * time.Second
+
+// 按split取出第一帧作为key，只是Peek，不会消耗数据
+// 第一帧超过读缓冲的长度，或者DefaultPeekTimeout内没有读到时，返回空串
+// 之后恢复通过Conn设置的读超时
+func PeekKey(split bufio.SplitFunc) KeyFunc {
+	return func(c *network.Conn) string {
+		reader := c.GetReader()
+		if reader == nil {
+			return ""
+		}
+		raw := c.GetRawConn()
+		raw.SetReadDeadline(time.Now().Add(DefaultPeekTimeout))
+		defer raw.SetReadDeadline(c.GetReadDeadline()) // 恢复原来的读超时
+		for n := 1; ; {
+			data, err := reader.Peek(n)
+			if buffered := reader.Buffered(); buffered > len(data) {
+				data, _ = reader.Peek(buffered) // 已经读到的都拿来拆包
+			}
+			_, token, serr := split(data, err != nil)
+			if token != nil {
+				return string(token)
+			}
+			if err != nil || serr != nil || len(data) >= reader.Size() {
+				return ""
+			}
+			n = len(data) + 1
+		}
+	}
+}
+
+// 一致性哈希环，后端集合变化时只有少量key会改变后端
+type HashRing struct {
+	Replicas int // 每个后端的虚拟节点数
+	key      KeyFunc
+	backends []*Backend // 生成环时的后端列表
+	hashes   []uint32
+	nodes    map[uint32]*Backend
+	mutex    sync.RWMutex
+}
+
+func NewHashRing(key KeyFunc) *HashRing {
+	if key == nil {
+		key = ClientIP
+	}
+	return &HashRing{Replicas: 160, key: key}
+}
+
+// 后端列表是否和生成环时相同，每次Update都会生成新的切片
+func (p *HashRing) isCurrent(backends []*Backend) bool {
+	return len(backends) == len(p.backends) && &backends[0] == &p.backends[0]
+}
+
+// 重新生成环，调用时要持有写锁
+func (p *HashRing) build(backends []*Backend) {
+	p.hashes = p.hashes[:0]
+	p.nodes = make(map[uint32]*Backend)
+	for _, b := range backends {
+		name := b.String()
+		for i := 0; i < p.Replicas*b.GetWeight(); i++ {
+			hash := crc32.ChecksumIEEE([]byte(name + "#" + strconv.Itoa(i)))
+			if _, ok := p.nodes[hash]; !ok {
+				p.nodes[hash] = b
+				p.hashes = append(p.hashes, hash)
+			}
+		}
+	}
+	sort.Slice(p.hashes, func(i, j int) bool {
+		return p.hashes[i] < p.hashes[j]
+	})
+	p.backends = backends
+}
+
+// 在环上查找，调用时要持有锁
+func (p *HashRing) lookup(hash uint32) *Backend {
+	if len(p.hashes) == 0 {
+		return nil
+	}
+	i := sort.Search(len(p.hashes), func(i int) bool {
+		return p.hashes[i] >= hash
+	})
+	if i == len(p.hashes) {
+		i = 0
+	}
+	return p.nodes[p.hashes[i]]
+}
+
+// 先取得key再加锁，等待客户端数据时不会挡住其他连接
+// 查找和生成环在同一次加锁中，用的环总是和backends一致
+func (p *HashRing) Pick(c *network.Conn, backends []*Backend) *Backend {
+	hash := crc32.ChecksumIEEE([]byte(p.key(c)))
+	p.mutex.RLock()
+	if p.backends != nil && p.isCurrent(backends) {
+		defer p.mutex.RUnlock()
+		return p.lookup(hash)
+	}
+	p.mutex.RUnlock()
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.backends == nil || !p.isCurrent(backends) {
+		p.build(backends)
+	}
+	return p.lookup(hash)
+}
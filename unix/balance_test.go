@@ -0,0 +1,259 @@
+package unix
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/azhai/gozzo-net/network"
+)
+
+func testBackends(weights ...int) []*Backend {
+	var backends []*Backend
+	for i, weight := range weights {
+		addr := network.NewTCPAddr("127.0.0.1", uint16(10001+i))
+		backends = append(backends, NewBackend(addr, weight))
+	}
+	return backends
+}
+
+// 创建一对TCP连接，返回服务端一侧的Conn和客户端
+func tcpPair(t testing.TB) (*network.Conn, net.Conn) {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := ln.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return network.NewTCPConn(conn), client
+}
+
+func countPicks(b *Balancer, c *network.Conn, n int) map[string]int {
+	counts := make(map[string]int)
+	for i := 0; i < n; i++ {
+		backend := b.Pick(c, b.Backends())
+		counts[backend.String()]++
+	}
+	return counts
+}
+
+func TestRoundRobin(t *testing.T) {
+	backends := testBackends(1, 1, 1)
+	b := NewRoundRobin(backends...)
+	counts := countPicks(b, nil, 6)
+	for _, backend := range backends {
+		if counts[backend.String()] != 2 {
+			t.Fatalf("uneven picks: %v", counts)
+		}
+	}
+}
+
+func TestWeighted(t *testing.T) {
+	backends := testBackends(5, 1, 1)
+	b := NewWeightedRoundRobin(backends...)
+	var order string
+	for i := 0; i < 7; i++ {
+		backend := b.Pick(nil, b.Backends())
+		for j := range backends {
+			if backend == backends[j] {
+				order += string('a' + byte(j))
+			}
+		}
+	}
+	if order != "aabacaa" {
+		t.Fatalf("smooth weighted order is %s", order)
+	}
+}
+
+func TestLeastConn(t *testing.T) {
+	backends := testBackends(1, 1, 1)
+	b := NewLeastConn(backends...)
+	var conns []*network.Conn
+	for i := 0; i < 3; i++ {
+		c, client := tcpPair(t)
+		defer client.Close()
+		_, dp := b.Dispatch(c)
+		b.Track(c, dp)
+		conns = append(conns, c)
+	}
+	for _, backend := range backends {
+		if backend.Active() != 1 {
+			t.Fatalf("%s has %d active connections", backend, backend.Active())
+		}
+	}
+	// 关闭第二个连接后，它的后端连接最少
+	conns[1].Close()
+	deadline := time.Now().Add(time.Second)
+	for backends[1].Active() != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if backend := b.Pick(nil, b.Backends()); backend != backends[1] {
+		t.Fatalf("picked %s instead of %s", backend, backends[1])
+	}
+	for _, c := range conns {
+		c.Close()
+	}
+}
+
+func TestTwoChoices(t *testing.T) {
+	backends := testBackends(1, 1)
+	b := NewTwoChoices(backends...)
+	addActive(backends[0], 5)
+	for i := 0; i < 10; i++ {
+		if backend := b.Pick(nil, b.Backends()); backend != backends[1] {
+			t.Fatalf("picked the busy backend %s", backend)
+		}
+	}
+}
+
+func addActive(b *Backend, n int64) {
+	for i := int64(0); i < n; i++ {
+		c := network.NewTCPConn(nil)
+		b.track(c) // 不活动的连接不会关闭，计数一直保留
+	}
+}
+
+func TestConsistentHash(t *testing.T) {
+	var key string
+	backends := testBackends(1, 1, 1)
+	b := NewConsistentHash(func(c *network.Conn) string { return key }, backends...)
+	before := make(map[string]*Backend)
+	for i := 0; i < 1000; i++ {
+		key = fmt.Sprintf("client-%d", i)
+		before[key] = b.Pick(nil, b.Backends())
+		if again := b.Pick(nil, b.Backends()); again != before[key] {
+			t.Fatalf("key %s moved from %s to %s", key, before[key], again)
+		}
+	}
+	// 增加一个后端，只有约四分之一的key改变
+	b.Add(testBackends(1, 1, 1, 1)[3])
+	moved := 0
+	for k, old := range before {
+		key = k
+		if b.Pick(nil, b.Backends()).String() != old.String() {
+			moved++
+		}
+	}
+	if moved == 0 || moved > 400 {
+		t.Fatalf("%d of 1000 keys moved", moved)
+	}
+}
+
+func TestUpdateKeepsStats(t *testing.T) {
+	b := NewLeastConn(testBackends(1, 1)...)
+	c, client := tcpPair(t)
+	defer client.Close()
+	defer c.Close()
+	kind, plan := b.Dispatch(c)
+	if kind != "tcp" || plan == nil {
+		t.Fatalf("dispatch got %s, %v", kind, plan)
+	}
+	b.Track(c, plan)
+	// 用新的对象替换后端，正在转发的连接仍然计入
+	b.Update(testBackends(1, 1, 1)...)
+	active := 0
+	for _, backend := range b.Backends() {
+		active += backend.Active()
+	}
+	if active != 1 || len(b.Backends()) != 3 {
+		t.Fatalf("%d active connections in %d backends", active, len(b.Backends()))
+	}
+	b.Update()
+	if kind, plan = b.Dispatch(c); plan != nil {
+		t.Fatalf("dispatch to %s without backends", kind)
+	}
+}
+
+func TestPeekKey(t *testing.T) {
+	c, client := tcpPair(t)
+	defer client.Close()
+	defer c.Close()
+	go func() {
+		client.Write([]byte("user42\n"))
+		time.Sleep(10 * time.Millisecond)
+		client.Write([]byte("rest"))
+		client.Close()
+	}()
+	if key := PeekKey(bufio.ScanLines)(c); key != "user42" {
+		t.Fatalf("got key %q", key)
+	}
+	data, err := ioutil.ReadAll(c.GetReader())
+	if err != nil || string(data) != "user42\nrest" {
+		t.Fatalf("got %q, %v", data, err)
+	}
+}
+
+// Peek之后恢复原来的读超时，不能变成不限
+func TestPeekKeyDeadline(t *testing.T) {
+	c, client := tcpPair(t)
+	defer client.Close()
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	client.Write([]byte("user42\n"))
+	if key := PeekKey(bufio.ScanLines)(c); key != "user42" {
+		t.Fatalf("got key %q", key)
+	}
+	reader := c.GetReader()
+	reader.Discard(reader.Buffered())
+	done := make(chan error, 1)
+	go func() {
+		_, err := reader.ReadByte()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+			t.Fatalf("read returned %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the read deadline was cleared")
+	}
+}
+
+// 一个客户端迟迟不发数据，不能挡住其他客户端，等待超时后key为空
+func TestHashRingSlowClient(t *testing.T) {
+	defer func(orig time.Duration) { DefaultPeekTimeout = orig }(DefaultPeekTimeout)
+	DefaultPeekTimeout = 500 * time.Millisecond
+	slow, slowClient := tcpPair(t)
+	defer slowClient.Close()
+	defer slow.Close()
+	fast, fastClient := tcpPair(t)
+	defer fastClient.Close()
+	defer fast.Close()
+	fastClient.Write([]byte("user42\n"))
+
+	ring := NewHashRing(PeekKey(bufio.ScanLines))
+	list := []*Backend{NewBackend(deadAddr(t), 1), NewBackend(deadAddr(t), 1)}
+	slowDone := make(chan time.Duration, 1)
+	go func() {
+		start := time.Now()
+		ring.Pick(slow, list)
+		slowDone <- time.Since(start)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	start := time.Now()
+	if ring.Pick(fast, append([]*Backend(nil), list...)) == nil { // 新的列表，需要重建
+		t.Fatal("no backend picked")
+	}
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Fatalf("pick was blocked for %s", elapsed)
+	}
+	select {
+	case elapsed := <-slowDone:
+		if elapsed < 400*time.Millisecond {
+			t.Fatalf("slow pick returned after %s", elapsed)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("peek did not time out")
+	}
+}
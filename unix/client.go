@@ -1,7 +1,9 @@
 package unix
 
 import (
+	"fmt"
 	"os"
+	"path/filepath"
 
 	"github.com/azhai/gozzo-net/network"
 	"github.com/azhai/gozzo-utils/filesystem"
@@ -9,6 +11,7 @@ import (
 
 // Unix socket 客户端.
 type UnixClient struct {
+	kind     string
 	options  network.Options
 	dialplan *network.DialPlan
 	Conn     *network.Conn
@@ -16,7 +19,24 @@ type UnixClient struct {
 
 // 创建Unix客户端
 func NewClient(plan *network.DialPlan, opts network.Options) *UnixClient {
-	return &UnixClient{dialplan: plan, options: opts}
+	return &UnixClient{kind: "unix", dialplan: plan, options: opts}
+}
+
+// 创建unixgram客户端，没有本地地址时使用临时sock文件，以便收到回应
+// 拨号计划可能是共用的，复制一份再设置本地地址
+func NewGramClient(plan *network.DialPlan, opts network.Options) *UnixClient {
+	if plan.LocalAddr == nil {
+		copied := *plan
+		name := fmt.Sprintf("gozzo-%s.sock", network.RandomGUID())
+		copied.LocalAddr = network.NewUnixAddr(filepath.Join(os.TempDir(), name))
+		plan = &copied
+	}
+	return &UnixClient{kind: "unixgram", dialplan: plan, options: opts}
+}
+
+// 创建unixpacket客户端
+func NewPacketClient(plan *network.DialPlan, opts network.Options) *UnixClient {
+	return &UnixClient{kind: "unixpacket", dialplan: plan, options: opts}
 }
 
 func (c *UnixClient) Close() error {
@@ -24,11 +44,25 @@ func (c *UnixClient) Close() error {
 	if c.Conn != nil {
 		err = c.Conn.Close()
 	}
+	if rmErr := c.removeLocal(); rmErr != nil {
+		err = rmErr
+	}
+	return err
+}
+
+// 删除本地的sock文件
+func (c *UnixClient) removeLocal() (err error) {
+	if c.dialplan.LocalAddr == nil {
+		return
+	}
 	filename := c.dialplan.LocalAddr.String()
+	if network.IsAbstractUnix(filename) {
+		return
+	}
 	if _, exists := filesystem.FileSize(filename); exists {
 		err = os.Remove(filename)
 	}
-	return err
+	return
 }
 
 func (c *UnixClient) GetPlan() *network.DialPlan {
@@ -44,10 +78,24 @@ func (c *UnixClient) SetConn(conn *network.Conn) {
 }
 
 func (c *UnixClient) Dialing() (*network.Conn, error) {
-	conn, err := c.dialplan.DialUnix()
+	if c.kind == "unixgram" { // 重连时，上一次绑定的sock文件还在
+		c.removeLocal()
+	}
+	conn, err := c.dialplan.DialUnixKind(c.kind)
 	if err == nil && conn != nil {
-		err = c.options.ApplyConn(conn)
-		return network.NewUnixConn(conn), err
+		var nc *network.Conn
+		switch c.kind {
+		case "unixgram":
+			nc = network.NewUnixgramConn(conn)
+		case "unixpacket":
+			nc = network.NewUnixpacketConn(conn)
+		default:
+			nc = network.NewUnixConn(conn)
+		}
+		if err = c.options.ApplyConn(conn); err == nil {
+			err = c.options.ApplyDeadline(nc)
+		}
+		return nc, err
 	}
 	return nil, err
 }
@@ -0,0 +1,143 @@
+package unix
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/azhai/gozzo-net/network"
+)
+
+// 代理认证失败
+var ErrConnectAuth = fmt.Errorf("Proxy authentication failed")
+
+// HTTP CONNECT前端，只接受CONNECT host:port请求
+// Users: Basic认证的用户名和密码，为空时不需要认证
+// Policy: 目标的访问策略，为nil时允许所有目标
+// Realm: 要求认证时返回的realm
+// Timeout: 读取请求的超时，连接后端的超时见Proxy.ConnectTimeout
+type HTTPConnect struct {
+	Users   map[string]string
+	Policy  *AccessPolicy
+	Realm   string
+	Timeout time.Duration
+}
+
+func NewHTTPConnect(users map[string]string, policy *AccessPolicy) *HTTPConnect {
+	return &HTTPConnect{
+		Users:   users,
+		Policy:  policy,
+		Realm:   "gozzo",
+		Timeout: DefaultHandshakeTimeout,
+	}
+}
+
+// 作为HTTP代理，收到CONNECT请求后连接目标，回应200之后的数据由action转发
+func (p *Proxy) CreateHTTPConnect(hc *HTTPConnect, action ProxyAction) network.ProcessFunc {
+	return func(s *network.Server, c *network.Conn) {
+		raw := c.GetRawConn()
+		if hc.Timeout > 0 {
+			raw.SetDeadline(time.Now().Add(hc.Timeout))
+		}
+		addr, err := hc.Handshake(c)
+		if err != nil {
+			return
+		}
+		raw.SetDeadline(time.Time{})
+		client, err := p.connect(c, &Relayer{Kind: "tcp", DialPlan: network.NewDialPlan(addr, nil, 10)}, false)
+		if err != nil {
+			hc.respond(c, connectStatus(err), nil)
+			if p.ConnectFailed != nil {
+				p.ConnectFailed(s, c, err)
+			}
+			return
+		}
+		defer client.Close()
+		if err = c.QuickSend([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err == nil {
+			action(s, c, client.GetConn()) // 请求之后已经读入缓冲的数据也会转发
+		}
+	}
+}
+
+// 读取并检查CONNECT请求，返回允许访问的目标地址
+// 出错时已经回应了客户端
+func (hc *HTTPConnect) Handshake(c *network.Conn) (*net.TCPAddr, error) {
+	method, err := c.Peek(len(http.MethodConnect) + 1)
+	if err != nil {
+		return nil, err
+	}
+	if string(method) != http.MethodConnect+" " {
+		hc.respond(c, http.StatusMethodNotAllowed, http.Header{"Allow": {http.MethodConnect}})
+		return nil, fmt.Errorf("Not a CONNECT request")
+	}
+	req, err := http.ReadRequest(c.GetReader())
+	if err != nil {
+		hc.respond(c, http.StatusBadRequest, nil)
+		return nil, err
+	}
+	if !hc.authorized(req.Header.Get("Proxy-Authorization")) {
+		realm := fmt.Sprintf("Basic realm=%q", hc.Realm)
+		hc.respond(c, http.StatusProxyAuthRequired, http.Header{"Proxy-Authenticate": {realm}})
+		return nil, ErrConnectAuth
+	}
+	host, portStr, err := net.SplitHostPort(req.Host)
+	port, _ := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		hc.respond(c, http.StatusBadRequest, nil)
+		return nil, fmt.Errorf("Bad CONNECT target %q", req.Host)
+	}
+	addr, err := hc.Policy.Resolve(host, port)
+	if err != nil {
+		hc.respond(c, connectStatus(err), nil)
+		return nil, err
+	}
+	return addr, nil
+}
+
+// 检查Proxy-Authorization: Basic base64(user:pass)
+func (hc *HTTPConnect) authorized(auth string) bool {
+	if len(hc.Users) == 0 {
+		return true
+	}
+	const prefix = "Basic "
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return false
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(auth[len(prefix):]))
+	if err != nil {
+		return false
+	}
+	pieces := strings.SplitN(string(data), ":", 2)
+	if len(pieces) != 2 {
+		return false
+	}
+	expect, ok := hc.Users[pieces[0]]
+	return ok && subtle.ConstantTimeCompare([]byte(expect), []byte(pieces[1])) == 1
+}
+
+// 回应错误，之后连接会被关闭
+func (hc *HTTPConnect) respond(c *network.Conn, code int, header http.Header) error {
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "HTTP/1.1 %d %s\r\n", code, http.StatusText(code))
+	header.Write(&buf)
+	buf.WriteString("Content-Length: 0\r\nConnection: close\r\n\r\n")
+	return c.QuickSend([]byte(buf.String()))
+}
+
+// 按连接失败的原因选择状态码
+func connectStatus(err error) int {
+	switch socksReplyCode(err) {
+	case replyNotAllowed:
+		return http.StatusForbidden
+	case replyHostUnreachable:
+		if netErr, ok := lastConnectError(err).(net.Error); ok && netErr.Timeout() {
+			return http.StatusGatewayTimeout
+		}
+	}
+	return http.StatusBadGateway
+}
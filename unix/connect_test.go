@@ -0,0 +1,87 @@
+package unix
+
+import (
+	"bufio"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/azhai/gozzo-net/network"
+)
+
+func runConnectProxy(t *testing.T, hc *HTTPConnect) string {
+	addr := deadAddr(t)
+	proxy := NewProxy("tcp", "127.0.0.1", uint16(addr.Port))
+	ready := make(chan bool)
+	events := network.Events{
+		Serving: func(s *network.Server) { ready <- true },
+		Process: proxy.CreateHTTPConnect(hc, RelayData),
+	}
+	go proxy.Run(events)
+	<-ready
+	return addr.String()
+}
+
+// 发出请求，返回状态码和之后可以继续读的reader
+func sendConnect(t *testing.T, address, request string) (net.Conn, *bufio.Reader, int) {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	conn.Write([]byte(request))
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, reader, resp.StatusCode
+}
+
+func TestHTTPConnect(t *testing.T) {
+	backend := tcpEchoBackend(t, "127.0.0.1:0")
+	defer backend.Close()
+	target := backend.Addr().String()
+	policy := &AccessPolicy{Allow: []string{target}}
+	address := runConnectProxy(t, NewHTTPConnect(map[string]string{"bob": "pass"}, policy))
+
+	auth := "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte("bob:pass")) + "\r\n"
+	// 请求之后紧跟的数据也要转发
+	conn, reader, code := sendConnect(t, address,
+		"CONNECT "+target+" HTTP/1.1\r\nHost: "+target+"\r\n"+auth+"\r\nhello\n")
+	if code != http.StatusOK {
+		t.Fatalf("status %d", code)
+	}
+	if line, err := reader.ReadString('\n'); line != "hello\n" {
+		t.Fatalf("got %q, %v", line, err)
+	}
+	conn.Close()
+
+	cases := []struct {
+		request string
+		code    int
+	}{
+		{"CONNECT " + target + " HTTP/1.1\r\n\r\n", http.StatusProxyAuthRequired},
+		{"CONNECT 127.0.0.1:25 HTTP/1.1\r\n" + auth + "\r\n", http.StatusForbidden},
+		{"CONNECT " + target + " HTTP/1.1\r\nProxy-Authorization: Basic Ym9iOm5vcGU=\r\n\r\n", http.StatusProxyAuthRequired},
+		{"GET http://" + target + "/ HTTP/1.1\r\n\r\n", http.StatusMethodNotAllowed},
+		{"CONNECT nowhere HTTP/1.1\r\n" + auth + "\r\n", http.StatusBadRequest},
+	}
+	for _, cs := range cases {
+		conn, _, code = sendConnect(t, address, cs.request)
+		conn.Close()
+		if code != cs.code {
+			t.Fatalf("%q: status %d, want %d", cs.request, code, cs.code)
+		}
+	}
+
+	dead := deadAddr(t).String()
+	address = runConnectProxy(t, NewHTTPConnect(nil, nil))
+	conn, _, code = sendConnect(t, address, "CONNECT "+dead+" HTTP/1.1\r\n\r\n")
+	conn.Close()
+	if code != http.StatusBadGateway {
+		t.Fatalf("status %d for a refused target", code)
+	}
+}
@@ -0,0 +1,156 @@
+package unix
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/azhai/gozzo-net/network"
+)
+
+const (
+	DefaultConnectTimeout = 3 * time.Second  // 每次连接后端的超时
+	DefaultConnectBudget  = 10 * time.Second // 所有后端加起来的连接时间
+)
+
+// 路由没有给出后端
+var ErrNoBackend = fmt.Errorf("No backend")
+
+// 可以提供其他后端的路由，连接失败时切换
+// tried为已经失败的拨号计划，没有其他后端时返回nil
+type IFailover interface {
+	Failover(c *network.Conn, tried []*network.DialPlan) (string, *network.DialPlan)
+}
+
+// 连接后端失败，包含每次尝试的错误
+type ConnectError struct {
+	Addrs    []string
+	Errors   []error
+	Duration time.Duration
+}
+
+func (e *ConnectError) Error() string {
+	var parts []string
+	for i, err := range e.Errors {
+		parts = append(parts, fmt.Sprintf("%s: %v", e.Addrs[i], err))
+	}
+	return fmt.Sprintf("Connect failed after %d attempts in %s (%s)",
+		len(e.Errors), e.Duration, strings.Join(parts, "; "))
+}
+
+// 最后一次尝试的错误，不是ConnectError时原样返回
+func lastConnectError(err error) error {
+	if cerr, ok := err.(*ConnectError); ok && len(cerr.Errors) > 0 {
+		return cerr.Errors[len(cerr.Errors)-1]
+	}
+	return err
+}
+
+// 从可用的后端中去掉已经失败的，再选一个
+func (b *Balancer) Failover(c *network.Conn, tried []*network.DialPlan) (string, *network.DialPlan) {
+	var backends []*Backend
+	for _, backend := range b.Usable() {
+		if !containsPlan(tried, backend.DialPlan) {
+			backends = append(backends, backend)
+		}
+	}
+	if len(backends) == 0 {
+		return "", nil
+	}
+	backend := b.Pick(c, backends)
+	if backend == nil {
+		return "", nil
+	}
+	return backend.Kind, backend.DialPlan
+}
+
+// 在Dispatch匹配的规则中切换，不再嗅探
+func (s *Sniffer) Failover(c *network.Conn, tried []*network.DialPlan) (string, *network.DialPlan) {
+	if rule := s.match(c); rule != nil {
+		if fo, ok := rule.Router.(IFailover); ok {
+			return fo.Failover(c, tried)
+		}
+	}
+	return "", nil
+}
+
+func containsPlan(plans []*network.DialPlan, dp *network.DialPlan) bool {
+	for _, plan := range plans {
+		if plan == dp {
+			return true
+		}
+	}
+	return false
+}
+
+// 依次连接路由给出的后端，失败时立即换下一个，直到成功或用完ConnectBudget
+// 每次连接的超时为ConnectTimeout，并且不超过剩余的时间
+// pooled为true时先从连接池中取
+func (p *Proxy) connect(c *network.Conn, router IRouter, pooled bool) (network.IClient, error) {
+	fb, _ := router.(IFeedback)
+	fo, _ := router.(IFailover)
+	tr, _ := router.(ITracker)
+	start := time.Now()
+	cerr := new(ConnectError)
+	var tried []*network.DialPlan
+	kind, dp := router.Dispatch(c)
+	for dp != nil {
+		if pooled {
+			if client := p.takePooled(kind, dp); client != nil {
+				if fb != nil {
+					fb.Feedback(dp, nil)
+				}
+				if tr != nil {
+					tr.Track(c, dp)
+				}
+				return client, nil
+			}
+		}
+		timeout := p.ConnectTimeout
+		if timeout <= 0 || dp.Timeout > 0 && dp.Timeout < timeout {
+			timeout = dp.Timeout
+		}
+		if p.ConnectBudget > 0 {
+			remain := p.ConnectBudget - time.Since(start)
+			if remain <= 0 {
+				break
+			}
+			if timeout <= 0 || remain < timeout {
+				timeout = remain
+			}
+		}
+		plan := *dp // 拨号计划是共用的，不能直接修改
+		plan.Timeout = timeout
+		client := p.CreateClient(kind, &plan)
+		if client == nil {
+			break
+		}
+		conn, err := client.Dialing()
+		if fb != nil {
+			fb.Feedback(dp, err)
+		}
+		if err == nil {
+			if tr != nil {
+				tr.Track(c, dp)
+			}
+			client.SetConn(conn)
+			return client, nil
+		}
+		if conn != nil {
+			conn.Close()
+		}
+		tried = append(tried, dp)
+		cerr.Addrs = append(cerr.Addrs, dp.RemoteAddr.String())
+		cerr.Errors = append(cerr.Errors, err)
+		if fo == nil {
+			break
+		}
+		kind, dp = fo.Failover(c, tried)
+	}
+	cerr.Duration = time.Since(start)
+	if len(cerr.Errors) == 0 {
+		cerr.Errors = append(cerr.Errors, ErrNoBackend)
+		cerr.Addrs = append(cerr.Addrs, "-")
+	}
+	return nil, cerr
+}
@@ -0,0 +1,108 @@
+package unix
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/azhai/gozzo-net/network"
+)
+
+func runFailoverProxy(t *testing.T, router IRouter) (string, chan error) {
+	addr := deadAddr(t)
+	proxy := NewProxy("tcp", "127.0.0.1", uint16(addr.Port))
+	failures := make(chan error, 10)
+	proxy.ConnectFailed = func(s *network.Server, c *network.Conn, err error) {
+		failures <- err
+	}
+	ready := make(chan bool)
+	events := network.Events{
+		Serving: func(s *network.Server) { ready <- true },
+		Process: proxy.CreateProcess(router, RelayData),
+	}
+	go proxy.Run(events)
+	<-ready
+	return addr.String(), failures
+}
+
+func TestFailover(t *testing.T) {
+	live := tcpEchoBackend(t, "127.0.0.1:0")
+	defer live.Close()
+	router := NewRoundRobin(NewBackend(deadAddr(t), 1),
+		NewBackend(deadAddr(t), 1), NewBackend(live.Addr(), 1))
+	address, failures := runFailoverProxy(t, router)
+
+	// 每个连接都会切换到唯一可用的后端
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(time.Second))
+		conn.Write([]byte("hello\n"))
+		if line, err := bufio.NewReader(conn).ReadString('\n'); line != "hello\n" {
+			t.Fatalf("connection %d got %q, %v", i, line, err)
+		}
+		conn.Close()
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("failover took %s", elapsed)
+	}
+	if len(failures) != 0 {
+		t.Fatalf("unexpected failure %v", <-failures)
+	}
+	// 失败的尝试不计入连接数
+	for i, want := range []int{0, 0, 3} {
+		if backend := router.Backends()[i]; backend.Total() != want {
+			t.Fatalf("%s counted %d connections", backend, backend.Total())
+		}
+	}
+}
+
+func TestFailoverConsolidated(t *testing.T) {
+	router := NewRoundRobin(NewBackend(deadAddr(t), 1), NewBackend(deadAddr(t), 1))
+	address, failures := runFailoverProxy(t, router)
+
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	select {
+	case err = <-failures:
+	case <-time.After(3 * time.Second):
+		t.Fatal("no failure reported")
+	}
+	cerr, ok := err.(*ConnectError)
+	if !ok || len(cerr.Errors) != 2 || cerr.Addrs[0] == cerr.Addrs[1] {
+		t.Fatalf("got %v", err)
+	}
+	// 客户端只看到一次断开
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err = conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("connection should be closed")
+	}
+	if len(failures) != 0 {
+		t.Fatal("failure reported more than once")
+	}
+}
+
+// 默认的Relayer也经过统一的连接，不再等待重试，并且报告失败
+func TestRelayerConnectFailed(t *testing.T) {
+	address, failures := runFailoverProxy(t, NewRelayer(deadAddr(t)))
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	select {
+	case err = <-failures:
+	case <-time.After(time.Second):
+		t.Fatal("no failure reported")
+	}
+	if cerr, ok := err.(*ConnectError); !ok || len(cerr.Errors) != 1 {
+		t.Fatalf("got %v", err)
+	}
+}
@@ -0,0 +1,324 @@
+package unix
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/azhai/gozzo-net/network"
+)
+
+// 传输的数据达到TruncateAfter，连接被截断
+var ErrFaultTruncated = fmt.Errorf("Connection truncated by fault injection")
+
+// 一个方向上的故障，字段为0时不生效，JSON中的时间单位是纳秒
+// Latency, Jitter: 数据延迟Latency加上最多Jitter的随机时间后才写出，是固定的单向延迟，不影响吞吐
+// Bandwidth: 每秒最多写多少字节
+// DropAfter: 传输这么多字节后，之后的数据都被丢弃，连接保持不断
+// TruncateAfter: 传输这么多字节后断开连接
+// SliceSize, SliceDelay: 每次最多写SliceSize字节，两次之间等待SliceDelay
+type Faults struct {
+	Latency       time.Duration `json:"latency"`
+	Jitter        time.Duration `json:"jitter"`
+	Bandwidth     int           `json:"bandwidth"`
+	DropAfter     int64         `json:"drop_after"`
+	TruncateAfter int64         `json:"truncate_after"`
+	SliceSize     int           `json:"slice_size"`
+	SliceDelay    time.Duration `json:"slice_delay"`
+}
+
+// 故障配置，Upstream为客户端到后端，Downstream为后端到客户端
+// ResetEvery: 每个连接建立这么久之后被重置（RST）
+type FaultConfig struct {
+	Upstream   Faults        `json:"upstream"`
+	Downstream Faults        `json:"downstream"`
+	ResetEvery time.Duration `json:"reset_every"`
+}
+
+// 故障注入，类似toxiproxy，Relay方法就是ProxyAction
+// 配置可以在运行中修改，已经建立的连接在下一次写时生效，ResetEvery只对新连接生效
+// 实现了http.Handler，GET读取配置，PUT/POST修改配置（没有给出的字段不变），DELETE清除所有故障
+type FaultInjector struct {
+	Options RelayOptions
+	config  atomic.Value // *FaultConfig
+	mutex   sync.Mutex
+	resets  int64
+}
+
+func NewFaultInjector(cfg FaultConfig) *FaultInjector {
+	f := &FaultInjector{Options: DefaultRelayOptions}
+	f.Set(cfg)
+	return f
+}
+
+// 当前的配置
+func (f *FaultInjector) Config() FaultConfig {
+	return *f.config.Load().(*FaultConfig)
+}
+
+// 替换配置
+func (f *FaultInjector) Set(cfg FaultConfig) {
+	f.config.Store(&cfg)
+}
+
+// 修改部分配置
+func (f *FaultInjector) Update(modify func(cfg *FaultConfig)) FaultConfig {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	cfg := f.Config()
+	modify(&cfg)
+	f.Set(cfg)
+	return cfg
+}
+
+// 被重置的连接数
+func (f *FaultInjector) Resets() int {
+	return int(atomic.LoadInt64(&f.resets))
+}
+
+func (f *FaultInjector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var cfg FaultConfig
+	switch r.Method {
+	case http.MethodGet:
+		cfg = f.Config()
+	case http.MethodPut, http.MethodPost:
+		f.mutex.Lock()
+		cfg = f.Config()
+		err := json.NewDecoder(r.Body).Decode(&cfg)
+		if err == nil {
+			f.Set(cfg)
+		}
+		f.mutex.Unlock()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	case http.MethodDelete:
+		f.mutex.Lock()
+		f.Set(FaultConfig{})
+		f.mutex.Unlock()
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST, DELETE")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cfg)
+}
+
+// 按当前配置注入故障并转发，签名与ProxyAction相同
+func (f *FaultInjector) Relay(s *network.Server, orig, relay *network.Conn) {
+	origRaw, relayRaw := orig.GetRawConn(), relay.GetRawConn()
+	// 连接被重置或转发结束时，丢弃还在排队的延迟数据
+	done := make(chan struct{})
+	var once sync.Once
+	stop := func() { once.Do(func() { close(done) }) }
+	defer stop()
+	if every := f.Config().ResetEvery; every > 0 {
+		timer := time.AfterFunc(every, func() {
+			atomic.AddInt64(&f.resets, 1)
+			stop()
+			resetConn(origRaw)
+			resetConn(relayRaw)
+		})
+		defer timer.Stop()
+	}
+	upstream := &faultWriter{dst: relayRaw, injector: f, upstream: true, done: done}
+	downstream := &faultWriter{dst: origRaw, injector: f, done: done}
+	result := relayTo(orig, relay, upstream, downstream, f.Options)
+	relay.Close()
+	if f.Options.Finished != nil {
+		f.Options.Finished(s, orig, relay, result)
+	}
+}
+
+// 丢弃未发送的数据并发送RST
+func resetConn(conn network.INetConn) {
+	if tc, ok := conn.(*net.TCPConn); ok {
+		tc.SetLinger(0)
+	}
+	conn.Close()
+}
+
+// 限速时每秒最少写几次
+const bandwidthSteps = 20
+
+// 一个方向的写，每次写都读取最新的配置
+// 有延迟时数据带上到期时间排队，由后台按顺序写出，读这一方向的数据不会被挡住
+type faultWriter struct {
+	dst      io.Writer
+	injector *FaultInjector
+	upstream bool
+	written  int64     // 已经传输的字节数，包括被丢弃的
+	next     time.Time // 限速时下一次可以写的时间
+	queue    []delayedChunk
+	release  time.Time       // 最后一块的到期时间，抖动不能让数据乱序
+	running  bool            // 后台正在写出队列
+	err      error           // 后台写出的错误，下一次写时返回
+	done     <-chan struct{} // 关闭时丢弃排队的数据
+	mutex    sync.Mutex
+	cond     *sync.Cond
+}
+
+// 排队的数据和它可以写出的时间
+type delayedChunk struct {
+	data    []byte
+	release time.Time
+}
+
+func (w *faultWriter) faults() Faults {
+	cfg := w.injector.Config()
+	if w.upstream {
+		return cfg.Upstream
+	}
+	return cfg.Downstream
+}
+
+// 总是假装全部写完，被丢弃和截断的数据也计入
+// 截断时写完排队的数据后，同时返回ErrFaultTruncated
+func (w *faultWriter) Write(p []byte) (int, error) {
+	fs := w.faults()
+	size := len(p)
+	var err error
+	if fs.TruncateAfter > 0 && w.written+int64(len(p)) >= fs.TruncateAfter {
+		if remain := fs.TruncateAfter - w.written; remain > 0 {
+			p = p[:remain]
+		} else {
+			p = nil
+		}
+		err = ErrFaultTruncated
+	}
+	if fs.DropAfter > 0 {
+		if remain := fs.DropAfter - w.written; remain <= 0 {
+			p = nil
+		} else if int64(len(p)) > remain {
+			p = p[:remain]
+		}
+	}
+	w.written += int64(size)
+	if len(p) > 0 {
+		if werr := w.send(p, fs); werr != nil {
+			return 0, werr
+		}
+	}
+	if err != nil {
+		if ferr := w.Flush(); ferr != nil {
+			return 0, ferr
+		}
+	}
+	return size, err
+}
+
+// 没有延迟并且没有排队的数据时直接写，否则复制一份排队
+func (w *faultWriter) send(p []byte, fs Faults) error {
+	w.mutex.Lock()
+	if w.err != nil {
+		defer w.mutex.Unlock()
+		return w.err
+	}
+	if fs.Latency <= 0 && fs.Jitter <= 0 && len(w.queue) == 0 && !w.running {
+		w.mutex.Unlock()
+		return w.write(p, fs)
+	}
+	delay := fs.Latency
+	if fs.Jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(fs.Jitter)))
+	}
+	release := time.Now().Add(delay)
+	if release.Before(w.release) {
+		release = w.release
+	}
+	w.release = release
+	data := append([]byte(nil), p...)
+	w.queue = append(w.queue, delayedChunk{data: data, release: release})
+	if !w.running {
+		w.running = true
+		go w.drain()
+	}
+	w.mutex.Unlock()
+	return nil
+}
+
+// 按到期时间写出排队的数据，队列空了、出错或done被关闭时退出
+func (w *faultWriter) drain() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for len(w.queue) > 0 && w.err == nil {
+		chunk := w.queue[0]
+		w.queue = w.queue[1:]
+		w.mutex.Unlock()
+		err := w.wait(chunk.release)
+		if err == nil {
+			err = w.write(chunk.data, w.faults())
+		}
+		w.mutex.Lock()
+		w.err = err
+	}
+	w.queue = nil
+	w.running = false
+	w.getCond().Broadcast()
+}
+
+// 等到数据的到期时间，done被关闭时返回错误
+func (w *faultWriter) wait(release time.Time) error {
+	timer := time.NewTimer(time.Until(release))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-w.done:
+		return io.ErrClosedPipe
+	}
+}
+
+func (w *faultWriter) getCond() *sync.Cond {
+	if w.cond == nil {
+		w.cond = sync.NewCond(&w.mutex)
+	}
+	return w.cond
+}
+
+// 等待排队的数据全部写出，转发结束关闭写之前调用
+func (w *faultWriter) Flush() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for w.running {
+		w.getCond().Wait()
+	}
+	return w.err
+}
+
+// 分片和限速
+func (w *faultWriter) write(p []byte, fs Faults) error {
+	for len(p) > 0 {
+		chunk := p
+		if fs.SliceSize > 0 && len(chunk) > fs.SliceSize {
+			chunk = chunk[:fs.SliceSize]
+		}
+		if fs.Bandwidth > 0 {
+			if limit := fs.Bandwidth/bandwidthSteps + 1; len(chunk) > limit {
+				chunk = chunk[:limit] // 大块数据也分多次写，速度更平稳
+			}
+			if wait := time.Until(w.next); wait > 0 {
+				time.Sleep(wait)
+			} else {
+				w.next = time.Now()
+			}
+			w.next = w.next.Add(time.Duration(len(chunk)) * time.Second / time.Duration(fs.Bandwidth))
+		}
+		if _, err := w.dst.Write(chunk); err != nil {
+			return err
+		}
+		p = p[len(chunk):]
+		if len(p) > 0 && fs.SliceDelay > 0 {
+			time.Sleep(fs.SliceDelay)
+		}
+	}
+	return nil
+}
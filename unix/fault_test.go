@@ -0,0 +1,245 @@
+package unix
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/azhai/gozzo-net/network"
+)
+
+func runFaultProxy(t *testing.T, backend net.Addr, f *FaultInjector) string {
+	addr := deadAddr(t)
+	proxy := NewProxy("tcp", "127.0.0.1", uint16(addr.Port))
+	ready := make(chan bool)
+	events := network.Events{
+		Serving: func(s *network.Server) { ready <- true },
+		Process: proxy.CreateProcess(NewRelayer(backend), f.Relay),
+	}
+	go proxy.Run(events)
+	<-ready
+	return addr.String()
+}
+
+func dialFault(t *testing.T, address string) net.Conn {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	return conn
+}
+
+// 发送并读回，返回耗时
+func roundTrip(t *testing.T, conn net.Conn, data []byte) time.Duration {
+	start := time.Now()
+	conn.Write(data)
+	if _, err := io.ReadFull(conn, make([]byte, len(data))); err != nil {
+		t.Fatal(err)
+	}
+	return time.Since(start)
+}
+
+func TestFaultLatency(t *testing.T) {
+	backend := tcpEchoBackend(t, "127.0.0.1:0")
+	defer backend.Close()
+	f := NewFaultInjector(FaultConfig{Downstream: Faults{Latency: 100 * time.Millisecond}})
+	conn := dialFault(t, runFaultProxy(t, backend.Addr(), f))
+	defer conn.Close()
+
+	if elapsed := roundTrip(t, conn, []byte("hello")); elapsed < 100*time.Millisecond {
+		t.Fatalf("round trip took %s", elapsed)
+	}
+	// 运行中修改，对已有的连接生效
+	f.Update(func(cfg *FaultConfig) { cfg.Downstream.Latency = 0 })
+	if elapsed := roundTrip(t, conn, []byte("hello")); elapsed > 50*time.Millisecond {
+		t.Fatalf("round trip took %s", elapsed)
+	}
+	f.Update(func(cfg *FaultConfig) { cfg.Upstream.Bandwidth = 20000 })
+	if elapsed := roundTrip(t, conn, make([]byte, 5000)); elapsed < 200*time.Millisecond {
+		t.Fatalf("5000 bytes at 20000 B/s took %s", elapsed)
+	}
+}
+
+func TestFaultTruncateDrop(t *testing.T) {
+	backend, captured := captureBackend(t)
+	defer backend.Close()
+	f := NewFaultInjector(FaultConfig{
+		Upstream:   Faults{TruncateAfter: 5},
+		Downstream: Faults{DropAfter: 3},
+	})
+	conn := dialFault(t, runFaultProxy(t, backend.Addr(), f))
+	defer conn.Close()
+
+	// 后端的回应只收到前3个字节，之后被丢弃但连接没有断开
+	buf := make([]byte, 100)
+	n, err := io.ReadAtLeast(conn, buf, 3)
+	if err != nil || string(buf[:n]) != "ign" {
+		t.Fatalf("got %q, %v", buf[:n], err)
+	}
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, err = conn.Read(buf); n != 0 || err == nil || !err.(net.Error).Timeout() {
+		t.Fatalf("got %d bytes after the drop, %v", n, err)
+	}
+	// 后端只收到前5个字节，连接被关闭
+	conn.Write([]byte("hello world"))
+	select {
+	case data := <-captured:
+		if string(data) != "hello" {
+			t.Fatalf("backend got %q", data)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("upstream was not truncated")
+	}
+}
+
+func TestFaultReset(t *testing.T) {
+	backend := tcpEchoBackend(t, "127.0.0.1:0")
+	defer backend.Close()
+	f := NewFaultInjector(FaultConfig{ResetEvery: 100 * time.Millisecond})
+	conn := dialFault(t, runFaultProxy(t, backend.Addr(), f))
+	defer conn.Close()
+
+	roundTrip(t, conn, []byte("hello"))
+	_, err := conn.Read(make([]byte, 10))
+	if err == nil || err == io.EOF || err.(net.Error).Timeout() {
+		t.Fatalf("expected a reset, got %v", err)
+	}
+	if f.Resets() != 1 {
+		t.Fatalf("resets %d", f.Resets())
+	}
+}
+
+type countingWriter struct {
+	writes int
+	bytes.Buffer
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return w.Buffer.Write(p)
+}
+
+func TestFaultSlice(t *testing.T) {
+	dst := new(countingWriter)
+	f := NewFaultInjector(FaultConfig{Upstream: Faults{SliceSize: 4}})
+	w := &faultWriter{dst: dst, injector: f, upstream: true}
+	if n, err := w.Write([]byte("0123456789")); n != 10 || err != nil {
+		t.Fatalf("wrote %d, %v", n, err)
+	}
+	if dst.writes != 3 || dst.String() != "0123456789" {
+		t.Fatalf("%d writes of %q", dst.writes, dst.String())
+	}
+}
+
+// 延迟是固定的单向延迟：多次小的写不会累加，也不挡住调用者，抖动不会打乱顺序
+func TestFaultLatencyQueue(t *testing.T) {
+	dst := new(countingWriter)
+	f := NewFaultInjector(FaultConfig{Upstream: Faults{
+		Latency: 50 * time.Millisecond, Jitter: 20 * time.Millisecond}})
+	w := &faultWriter{dst: dst, injector: f, upstream: true}
+	start := time.Now()
+	var want bytes.Buffer
+	for i := 0; i < 10; i++ {
+		chunk := []byte{byte('0' + i)}
+		want.Write(chunk)
+		if n, err := w.Write(chunk); n != 1 || err != nil {
+			t.Fatalf("wrote %d, %v", n, err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 20*time.Millisecond {
+		t.Fatalf("writes were blocked for %s", elapsed)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	elapsed := time.Since(start)
+	if elapsed < 50*time.Millisecond || elapsed > 200*time.Millisecond {
+		t.Fatalf("10 delayed writes took %s", elapsed)
+	}
+	if dst.String() != want.String() {
+		t.Fatalf("got %q", dst.String())
+	}
+}
+
+func TestFaultAPI(t *testing.T) {
+	f := NewFaultInjector(FaultConfig{})
+	server := httptest.NewServer(f)
+	defer server.Close()
+
+	body := `{"upstream": {"latency": 1000000}, "reset_every": 5000000000}`
+	req, _ := http.NewRequest(http.MethodPut, server.URL, strings.NewReader(body))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("PUT: %v", err)
+	}
+	resp.Body.Close()
+	cfg := f.Config()
+	if cfg.Upstream.Latency != time.Millisecond || cfg.ResetEvery != 5*time.Second {
+		t.Fatalf("config %+v", cfg)
+	}
+
+	// 没有给出的字段保持不变，解析失败时不修改
+	resp, _ = http.Post(server.URL, "application/json", strings.NewReader(`{"downstream": {"bandwidth": 100}}`))
+	resp.Body.Close()
+	resp, _ = http.Post(server.URL, "application/json", strings.NewReader(`{"upstream": {"jitter": "x"}}`))
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("bad config got status %d", resp.StatusCode)
+	}
+	resp, err = http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(data), `"bandwidth":100`) || !strings.Contains(string(data), `"latency":1000000`) {
+		t.Fatalf("GET returned %s", data)
+	}
+}
+
+// 丢弃和截断都假装全部写完，截断时另外返回错误
+func TestFaultWriteCount(t *testing.T) {
+	dst := new(countingWriter)
+	f := NewFaultInjector(FaultConfig{
+		Upstream:   Faults{TruncateAfter: 5},
+		Downstream: Faults{DropAfter: 5},
+	})
+	up := &faultWriter{dst: dst, injector: f, upstream: true}
+	if n, err := up.Write([]byte("0123456789")); n != 10 || err != ErrFaultTruncated {
+		t.Fatalf("truncate wrote %d, %v", n, err)
+	}
+	down := &faultWriter{dst: dst, injector: f}
+	if n, err := down.Write([]byte("0123456789")); n != 10 || err != nil {
+		t.Fatalf("drop wrote %d, %v", n, err)
+	}
+	if dst.String() != "0123401234" {
+		t.Fatalf("got %q", dst.String())
+	}
+}
+
+// 连接被重置后，排队的延迟数据被丢弃，不再等到期
+func TestFaultLatencyStop(t *testing.T) {
+	dst := new(countingWriter)
+	f := NewFaultInjector(FaultConfig{Upstream: Faults{Latency: time.Hour}})
+	done := make(chan struct{})
+	w := &faultWriter{dst: dst, injector: f, upstream: true, done: done}
+	w.Write([]byte("late"))
+	close(done)
+	flushed := make(chan error, 1)
+	go func() { flushed <- w.Flush() }()
+	select {
+	case err := <-flushed:
+		if err == nil || dst.Len() != 0 {
+			t.Fatalf("flushed %q, %v", dst.String(), err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the queue kept waiting")
+	}
+}
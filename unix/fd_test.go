@@ -0,0 +1,69 @@
+// +build android darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package unix
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/azhai/gozzo-net/network"
+)
+
+// 通过Unix连接传递TCP连接，接收方接管后直接回应客户端
+func TestPassConn(t *testing.T) {
+	name := "@gozzo-test-" + network.RandomGUID()
+	listener, err := net.ListenUnix("unix", network.NewUnixAddr(name))
+	if err != nil {
+		t.Skip(err)
+	}
+	defer listener.Close()
+	front, err := net.DialUnix("unix", nil, listener.Addr().(*net.UnixAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	back, err := listener.AcceptUnix()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender, receiver := network.NewUnixConn(front), network.NewUnixConn(back)
+	defer sender.Close()
+	defer receiver.Close()
+
+	tcpListener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpListener.Close()
+	client, err := net.Dial("tcp", tcpListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	accepted, err := tcpListener.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig := network.NewTCPConn(accepted)
+	if err = sender.SendConn([]byte("device-1"), orig); err != nil {
+		t.Fatal(err)
+	}
+	orig.Close() // 交出后本进程不再持有
+
+	buf := make([]byte, 64)
+	n, c, err := receiver.RecvConn(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if string(buf[:n]) != "device-1" || c.GetKind() != "tcp" {
+		t.Fatalf("got %q, kind %s", buf[:n], c.GetKind())
+	}
+	c.QuickSend([]byte("hello\n"))
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	line, err := bufio.NewReader(client).ReadString('\n')
+	if err != nil || line != "hello\n" {
+		t.Fatalf("got %q, %v", line, err)
+	}
+}
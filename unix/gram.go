@@ -0,0 +1,111 @@
+// +build android darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package unix
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/azhai/gozzo-net/network"
+	"github.com/azhai/gozzo-utils/filesystem"
+)
+
+// 对端默认的空闲超时
+var DefaultIdleTimeout = 60 * time.Second
+
+// unixgram服务器，为每个对端地址创建一个虚拟连接，每条消息就是一帧
+// 对端需要绑定本地地址，否则收不到回应
+type UnixgramServer struct {
+	conn        *net.UnixConn
+	peers       *network.PeerTable
+	stop        chan struct{}
+	stopOnce    sync.Once
+	IdleTimeout time.Duration
+	*network.Server
+}
+
+// 创建unixgram服务器
+func NewGramServer(server *network.Server) *UnixgramServer {
+	return &UnixgramServer{
+		IdleTimeout: DefaultIdleTimeout,
+		Server:      server,
+	}
+}
+
+// 服务启动阶段，执行Tick事件
+func (s *UnixgramServer) Startup(events network.Events) (err error) {
+	addr := network.GetUnixAddr(s.Address)
+	if addr == nil {
+		return fmt.Errorf("The address is not a UnixAddr object")
+	}
+	opts := network.GetUnixOptions(s.Address)
+	if s.conn, err = ListenUnixgram(addr, opts); err != nil {
+		return
+	}
+	s.peers = network.NewPeerTable("unixgram", s.conn)
+	s.stop = make(chan struct{})
+	s.Trigger(events)
+	go s.peers.ExpireLoop(s.IdleTimeout, s.stop)
+	return
+}
+
+// 服务停止阶段，关闭每一个网络连接
+func (s *UnixgramServer) Shutdown(events network.Events) (err error) {
+	s.stopOnce.Do(func() {
+		if s.stop != nil {
+			close(s.stop)
+		}
+		if s.conn != nil {
+			err = s.conn.Close()
+		}
+		// 会话在自己的goroutine中结束，执行Closed事件
+		if s.peers != nil {
+			s.peers.Close()
+		}
+		s.Cleanup(nil)
+	})
+	filename := s.Server.Address.String()
+	if network.IsAbstractUnix(filename) {
+		return
+	}
+	if _, exists := filesystem.FileSize(filename); exists {
+		err = os.Remove(filename)
+	}
+	return
+}
+
+// 开始服务，接收消息，并按对端地址分发
+func (s *UnixgramServer) Run(events network.Events) (err error) {
+	runtime.GOMAXPROCS(runtime.NumCPU())
+	// 启动与停止
+	if err = s.Startup(events); err != nil {
+		return
+	}
+	defer s.Shutdown(events)
+	if events.Serving != nil {
+		events.Serving(s.Server)
+	}
+	// 循环接收和分发消息
+	var (
+		n    int
+		addr *net.UnixAddr
+		buf  = make([]byte, network.MaxMessageSize)
+	)
+	for {
+		n, addr, err = s.conn.ReadFromUnix(buf)
+		if err != nil {
+			if network.IsTemporaryError(err) {
+				continue
+			}
+			return
+		}
+		if addr == nil { // 对端没有绑定地址
+			addr = &net.UnixAddr{Net: "unixgram"}
+		}
+		s.peers.Dispatch(s.Server, events, addr, buf[:n])
+	}
+}
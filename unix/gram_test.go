@@ -0,0 +1,101 @@
+// +build android darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package unix
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/azhai/gozzo-net/network"
+)
+
+// 回应每一帧，不需要拆包
+func frameEvents(ready chan bool, frames chan string) network.Events {
+	return network.Events{
+		Serving: func(s *network.Server) {
+			ready <- true
+		},
+		Receive: func(c *network.Conn, data []byte, saved bool) (string, error) {
+			frames <- string(data)
+			return "", c.QuickSend(data)
+		},
+	}
+}
+
+func testMessages(t *testing.T, client *UnixClient, frames chan string) {
+	defer client.Close()
+	words := []string{"first", "second", "third"}
+	for _, word := range words {
+		if _, err := network.TrySendData(client, []byte(word), 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn := client.GetConn().GetRawConn()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 64)
+	for _, word := range words {
+		if frame := <-frames; frame != word {
+			t.Fatalf("frame %q != %q", frame, word)
+		}
+		n, err := conn.Read(buf)
+		if err != nil || string(buf[:n]) != word {
+			t.Fatalf("reply %q != %q, %v", buf[:n], word, err)
+		}
+	}
+}
+
+func TestUnixgram(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gozzo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "gram.sock")
+	server := NewGramServer(network.NewUnixServer(filename))
+	ready, frames := make(chan bool), make(chan string, 10)
+	events := frameEvents(ready, frames)
+	go server.Run(events)
+	defer server.Shutdown(events)
+	<-ready
+
+	plan := network.NewDialPlan(nil, nil, 0)
+	plan.SetUnixRemote(filename)
+	testMessages(t, NewGramClient(plan, network.Options{}), frames)
+	if plan.LocalAddr != nil {
+		t.Fatalf("the dial plan was changed to %s", plan.LocalAddr)
+	}
+	// 代理按后端的类型创建客户端
+	client := NewProxy("tcp", "", 0).CreateClient("unixgram", plan)
+	testMessages(t, client.(*UnixClient), frames)
+}
+
+func TestUnixpacket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gozzo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "packet.sock")
+	server := NewPacketServer(network.NewUnixServer(filename))
+	ready, frames := make(chan bool), make(chan string, 10)
+	events := frameEvents(ready, frames)
+	go func() {
+		if err := server.Run(events); err != nil {
+			select { // 启动失败
+			case ready <- false:
+			default:
+			}
+		}
+	}()
+	defer server.Shutdown(events)
+	if ok := <-ready; !ok {
+		t.Skip("unixpacket is not supported")
+	}
+
+	plan := network.NewDialPlan(nil, nil, 0)
+	plan.SetUnixRemote(filename)
+	testMessages(t, NewPacketClient(plan, network.Options{}), frames)
+}
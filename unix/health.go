@@ -0,0 +1,304 @@
+package unix
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/azhai/gozzo-net/network"
+	"github.com/azhai/gozzo-utils/metrics"
+)
+
+// 后端健康检查
+// Interval: 主动探测的间隔，为0时只做被动检查
+// Timeout: 每次探测的超时
+// Send, Expect: 探测时发送的数据和期望回应的开头，都为空时只检查能否连接
+// MaxFails: 连续失败（拨号或探测）多少次后摘除，为0时不摘除
+// Rises: 摘除后连续探测成功多少次恢复
+// EjectTime: 没有主动探测时，摘除多久之后重新尝试
+type HealthCheck struct {
+	Interval  time.Duration
+	Timeout   time.Duration
+	Send      []byte
+	Expect    []byte
+	MaxFails  int
+	Rises     int
+	EjectTime time.Duration
+}
+
+var DefaultHealthCheck = HealthCheck{
+	Timeout:   2 * time.Second,
+	MaxFails:  3,
+	Rises:     2,
+	EjectTime: 10 * time.Second,
+}
+
+// 探测一次后端，按后端的拨号计划连接，与转发走同样的路径
+func (h HealthCheck) Probe(b *Backend) error {
+	if b.Kind == "udp" && len(h.Send) == 0 {
+		return nil // UDP无法只靠连接判断
+	}
+	plan := *b.DialPlan // 拨号计划是共用的，不能直接修改
+	plan.Timeout = h.Timeout
+	conn, err := plan.Dial(b.Kind)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(h.Timeout))
+	if len(h.Send) > 0 {
+		if _, err = conn.Write(h.Send); err != nil {
+			return err
+		}
+	}
+	if len(h.Expect) > 0 {
+		buf := make([]byte, len(h.Expect))
+		if _, err = io.ReadFull(conn, buf); err != nil {
+			return err
+		}
+		if !bytes.Equal(buf, h.Expect) {
+			return fmt.Errorf("Unexpected reply %q from %s", buf, b)
+		}
+	}
+	return nil
+}
+
+// 后端的健康状态
+type health struct {
+	down      int32 // 为1时已被摘除
+	fails     int   // 连续失败次数
+	rises     int   // 摘除后连续探测成功次数
+	downSince time.Time
+	ejections int64 // 累计摘除次数
+	failures  int64 // 累计失败次数
+	mutex     sync.Mutex
+}
+
+func (s *BackendStats) IsHealthy() bool {
+	return atomic.LoadInt32(&s.down) == 0
+}
+
+// 累计被摘除的次数
+func (s *BackendStats) Ejections() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return int(s.ejections)
+}
+
+// 累计失败次数
+func (s *BackendStats) Failures() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return int(s.failures)
+}
+
+// 连续失败次数
+func (s *BackendStats) Fails() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.fails
+}
+
+// 记录一次失败，返回是否因此被摘除
+func (s *BackendStats) fail(h HealthCheck) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.fails++
+	s.failures++
+	s.rises = 0
+	if !s.IsHealthy() {
+		s.downSince = time.Now() // 重新计算摘除时间
+		return false
+	}
+	if h.MaxFails <= 0 || s.fails < h.MaxFails {
+		return false
+	}
+	atomic.StoreInt32(&s.down, 1)
+	s.downSince = time.Now()
+	s.ejections++
+	return true
+}
+
+// 记录一次成功，返回是否因此恢复
+// 真实连接成功时立即恢复，探测成功需要连续Rises次
+func (s *BackendStats) succeed(h HealthCheck, probe bool) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.fails = 0
+	if s.IsHealthy() {
+		return false
+	}
+	if s.rises++; probe && s.rises < h.Rises {
+		return false
+	}
+	s.rises = 0
+	atomic.StoreInt32(&s.down, 0)
+	return true
+}
+
+// 摘除已超过EjectTime，重新尝试，再失败一次就会又被摘除
+func (s *BackendStats) retry(h HealthCheck) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.IsHealthy() || h.EjectTime <= 0 || time.Since(s.downSince) < h.EjectTime {
+		return false
+	}
+	atomic.StoreInt32(&s.down, 0)
+	return true
+}
+
+// 可用的后端，全部不可用时返回所有后端
+func (b *Balancer) Usable() []*Backend {
+	if b.Health.Interval <= 0 {
+		changed := false
+		for _, backend := range b.Backends() {
+			if backend.retry(b.Health) {
+				changed = true
+			}
+		}
+		if changed {
+			b.refresh()
+		}
+	}
+	if usable := b.usable.Load().([]*Backend); len(usable) > 0 {
+		return usable
+	}
+	return b.Backends()
+}
+
+// 重新生成可用的后端列表，健康状态变化时才替换，以免哈希环反复重建
+func (b *Balancer) refresh() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	var usable []*Backend
+	for _, backend := range b.Backends() {
+		if backend.IsHealthy() {
+			usable = append(usable, backend)
+		}
+	}
+	b.usable.Store(usable)
+}
+
+// 按拨号计划找到后端
+func (b *Balancer) findBackend(dp *network.DialPlan) *Backend {
+	for _, backend := range b.Backends() {
+		if backend.DialPlan == dp {
+			return backend
+		}
+	}
+	return nil
+}
+
+// 后端仍在集合中并且健康，拨号计划可能已被Update替换，按地址比较
+func (b *Balancer) IsUsable(kind string, dp *network.DialPlan) bool {
+	addr := dp.RemoteAddr.String()
+	for _, backend := range b.Backends() {
+		if backend.Kind == kind && backend.RemoteAddr.String() == addr {
+			return backend.IsHealthy()
+		}
+	}
+	return false
+}
+
+// 被动检查，记录连接后端的结果
+func (b *Balancer) Feedback(dp *network.DialPlan, err error) {
+	backend := b.findBackend(dp)
+	if backend == nil {
+		return
+	}
+	var changed bool
+	if err != nil {
+		changed = backend.fail(b.Health)
+	} else {
+		changed = backend.succeed(b.Health, false)
+	}
+	if changed {
+		b.refresh()
+	}
+}
+
+// 主动探测所有后端一次
+func (b *Balancer) CheckAll() {
+	var (
+		wg      sync.WaitGroup
+		changed int32
+	)
+	for _, backend := range b.Backends() {
+		wg.Add(1)
+		go func(backend *Backend) {
+			defer wg.Done()
+			var ok bool
+			if err := b.Health.Probe(backend); err != nil {
+				ok = backend.fail(b.Health)
+			} else {
+				ok = backend.succeed(b.Health, true)
+			}
+			if ok {
+				atomic.StoreInt32(&changed, 1)
+			}
+		}(backend)
+	}
+	wg.Wait()
+	if changed != 0 {
+		b.refresh()
+	}
+}
+
+// 开始定期主动探测，直到StopHealthCheck()
+func (b *Balancer) StartHealthCheck() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.Health.Interval <= 0 || b.stop != nil {
+		return
+	}
+	b.stop = make(chan struct{})
+	go func(stop chan struct{}) {
+		ticker := time.NewTicker(b.Health.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				b.CheckAll()
+			}
+		}
+	}(b.stop)
+}
+
+func (b *Balancer) StopHealthCheck() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.stop != nil {
+		close(b.stop)
+		b.stop = nil
+	}
+}
+
+// 后端状态的统计，名称为“后端.项目”
+// 项目有active, total, healthy, fails, failures, ejections
+func (b *Balancer) Metrics() metrics.Reporter {
+	backends := b.Backends()
+	var names []string
+	for _, backend := range backends {
+		for _, item := range []string{"active", "total", "healthy", "fails", "failures", "ejections"} {
+			names = append(names, backend.String()+"."+item)
+		}
+	}
+	r := metrics.NewDummyReporter(names)
+	for _, backend := range backends {
+		name := backend.String()
+		r.IncrCount(name+".active", int64(backend.Active()))
+		r.IncrCount(name+".total", int64(backend.Total()))
+		if backend.IsHealthy() {
+			r.IncrCount(name+".healthy", 1)
+		}
+		r.IncrCount(name+".fails", int64(backend.Fails()))
+		r.IncrCount(name+".failures", int64(backend.Failures()))
+		r.IncrCount(name+".ejections", int64(backend.Ejections()))
+	}
+	return r
+}
@@ -0,0 +1,180 @@
+package unix
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/azhai/gozzo-net/network"
+	"github.com/azhai/gozzo-utils/metrics"
+)
+
+// 回显的TCP后端
+func tcpEchoBackend(t *testing.T, address string) net.Listener {
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 1024)
+				for {
+					n, err := conn.Read(buf)
+					if err != nil {
+						return
+					}
+					conn.Write(buf[:n])
+				}
+			}()
+		}
+	}()
+	return ln
+}
+
+var errRefused = fmt.Errorf("connection refused")
+
+// 一个没有人监听的地址
+func deadAddr(t *testing.T) *net.TCPAddr {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+	return ln.Addr().(*net.TCPAddr)
+}
+
+func TestPassiveEjection(t *testing.T) {
+	live := tcpEchoBackend(t, "127.0.0.1:0")
+	defer live.Close()
+	dead := NewBackend(deadAddr(t), 1)
+	b := NewRoundRobin(dead, NewBackend(live.Addr(), 1))
+	b.Health.MaxFails = 2
+	b.Health.EjectTime = 100 * time.Millisecond
+
+	for i := 0; i < 2; i++ {
+		b.Feedback(dead.DialPlan, errRefused)
+	}
+	if dead.IsHealthy() || len(b.Usable()) != 1 {
+		t.Fatal("the dead backend should be ejected")
+	}
+	for i := 0; i < 4; i++ {
+		if _, dp := b.Dispatch(network.NewTCPConn(nil)); dp == dead.DialPlan {
+			t.Fatal("dispatched to an ejected backend")
+		}
+	}
+	snap := metrics.StatSnap(b.Metrics(), false)
+	if r := b.Metrics(); r.GetCount(dead.String()+".ejections") != 1 ||
+		r.GetCount(dead.String()+".healthy") != 0 {
+		t.Fatalf("metrics:%s", snap)
+	}
+	// 过了摘除时间后重新尝试
+	time.Sleep(150 * time.Millisecond)
+	if len(b.Usable()) != 2 {
+		t.Fatal("the ejected backend should be retried after EjectTime")
+	}
+	b.Feedback(dead.DialPlan, errRefused)
+	if dead.IsHealthy() {
+		t.Fatal("one more failure should eject the retried backend")
+	}
+}
+
+func TestActiveHealthCheck(t *testing.T) {
+	addr := deadAddr(t)
+	backend := NewBackend(addr, 1)
+	b := NewRoundRobin(backend)
+	b.Health.Interval = 20 * time.Millisecond
+	b.Health.Timeout = 100 * time.Millisecond
+	b.Health.Send, b.Health.Expect = []byte("ping"), []byte("ping")
+	b.StartHealthCheck()
+	defer b.StopHealthCheck()
+
+	waitFor := func(healthy bool) {
+		deadline := time.Now().Add(2 * time.Second)
+		for backend.IsHealthy() != healthy {
+			if time.Now().After(deadline) {
+				t.Fatalf("backend healthy should be %v", healthy)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	waitFor(false)
+	// 后端恢复后重新加入
+	live := tcpEchoBackend(t, addr.String())
+	defer live.Close()
+	waitFor(true)
+	if backend.Ejections() != 1 {
+		t.Fatalf("%d ejections", backend.Ejections())
+	}
+}
+
+func TestProxySkipsDeadBackend(t *testing.T) {
+	live := tcpEchoBackend(t, "127.0.0.1:0")
+	defer live.Close()
+	router := NewRoundRobin(NewBackend(deadAddr(t), 1), NewBackend(live.Addr(), 1))
+	router.Health.MaxFails = 1
+
+	proxyAddr := deadAddr(t)
+	proxy := NewProxy("tcp", "127.0.0.1", uint16(proxyAddr.Port))
+	ready := make(chan bool)
+	events := network.Events{
+		Serving: func(s *network.Server) { ready <- true },
+		Process: proxy.CreateProcess(router, RelayData),
+	}
+	go proxy.Run(events)
+	<-ready
+
+	// 失败的拨号不再重试等待，之后的连接都转到可用的后端
+	start := time.Now()
+	succeeded := 0
+	for i := 0; i < 6; i++ {
+		conn, err := net.Dial("tcp", proxyAddr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(time.Second))
+		conn.Write([]byte("hello\n"))
+		if line, _ := bufio.NewReader(conn).ReadString('\n'); line == "hello\n" {
+			succeeded++
+		}
+		conn.Close()
+	}
+	if succeeded < 5 {
+		t.Fatalf("only %d of 6 connections relayed", succeeded)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("took %s to skip the dead backend", elapsed)
+	}
+}
+
+// 探测使用后端的拨号计划，包括本地地址
+func TestProbeDialPlan(t *testing.T) {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	local := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 2)}
+	peers := make(chan net.Addr, 1)
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			peers <- conn.RemoteAddr()
+			conn.Close()
+		}
+	}()
+	backend := NewBackend(ln.Addr(), 1)
+	backend.LocalAddr = local
+	if err = DefaultHealthCheck.Probe(backend); err != nil {
+		t.Skip(err) // 不支持127.0.0.2
+	}
+	if peer := <-peers; !peer.(*net.TCPAddr).IP.Equal(local.IP) {
+		t.Fatalf("probe came from %s", peer)
+	}
+}
@@ -0,0 +1,136 @@
+// +build android darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package unix
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/azhai/gozzo-net/network"
+)
+
+// 探测旧sock文件是否还有人监听的超时
+var StaleTimeout = time.Second
+
+// 监听前的检查，残留的sock文件在确认无人监听后删除
+// kind为unix、unixgram或unixpacket
+func PrepareSocket(kind, name string, opts network.UnixOptions) error {
+	if network.IsAbstractUnix(name) {
+		if runtime.GOOS != "linux" && runtime.GOOS != "android" {
+			return fmt.Errorf("Abstract unix socket %s is only supported on Linux", name)
+		}
+		return nil
+	}
+	info, err := os.Lstat(name)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("The file %s exists and is not a socket", name)
+	}
+	if !opts.RemoveStale {
+		return nil // 交给Listen报错
+	}
+	if IsListening(kind, name) {
+		return fmt.Errorf("The socket %s is in use", name)
+	}
+	return os.Remove(name)
+}
+
+// 是否有进程在监听这个sock文件
+func IsListening(kind, name string) bool {
+	conn, err := net.DialTimeout(kind, name, StaleTimeout)
+	if err == nil {
+		conn.Close()
+		return true
+	}
+	if opErr, ok := err.(*net.OpError); ok {
+		if sysErr, ok := opErr.Err.(*os.SyscallError); ok {
+			// 只有拒绝连接和文件不存在，才能确定无人监听
+			return sysErr.Err != syscall.ECONNREFUSED && sysErr.Err != syscall.ENOENT
+		}
+	}
+	return true
+}
+
+// umask是整个进程的，所有的监听在这里排队修改它
+var umaskMutex sync.Mutex
+
+// 按设置的权限收紧umask后执行listen，sock文件创建时就不会有多余的权限
+// 注意：umask是整个进程的，listen期间其他goroutine创建的文件也使用收紧的umask
+// 只在设置了Mode时修改，并且只持续bind这一步
+func withUmask(name string, opts network.UnixOptions, listen func() error) error {
+	if opts.Mode == 0 || network.IsAbstractUnix(name) {
+		return listen()
+	}
+	umaskMutex.Lock()
+	defer umaskMutex.Unlock()
+	old := syscall.Umask(int(^opts.Mode.Perm() & 0777))
+	defer syscall.Umask(old)
+	return listen()
+}
+
+// 监听后设置sock文件的权限和属主，umask可能比设置的权限更严格，仍然要chmod
+func SetupSocket(name string, opts network.UnixOptions) (err error) {
+	if network.IsAbstractUnix(name) {
+		return
+	}
+	if opts.Mode != 0 {
+		if err = os.Chmod(name, opts.Mode); err != nil {
+			return
+		}
+	}
+	if uid, gid := opts.Owner(); uid >= 0 || gid >= 0 {
+		err = os.Lchown(name, uid, gid)
+	}
+	return
+}
+
+// 监听Unix socket，按参数处理残留文件、权限和属主，kind为unix或unixpacket
+// 设置了Mode时，监听期间临时修改进程的umask，见withUmask
+func ListenUnix(kind string, addr *net.UnixAddr, opts network.UnixOptions) (*net.UnixListener, error) {
+	if err := PrepareSocket(kind, addr.Name, opts); err != nil {
+		return nil, err
+	}
+	var listener *net.UnixListener
+	err := withUmask(addr.Name, opts, func() (err error) {
+		listener, err = net.ListenUnix(kind, addr)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	listener.SetUnlinkOnClose(true) // 关闭时删除sock文件，进程被杀掉时会残留
+	if err = SetupSocket(addr.Name, opts); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// 监听unixgram，按参数处理残留文件、权限和属主，umask同ListenUnix
+func ListenUnixgram(addr *net.UnixAddr, opts network.UnixOptions) (*net.UnixConn, error) {
+	if err := PrepareSocket("unixgram", addr.Name, opts); err != nil {
+		return nil, err
+	}
+	var conn *net.UnixConn
+	err := withUmask(addr.Name, opts, func() (err error) {
+		conn, err = net.ListenUnixgram("unixgram", addr)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err = SetupSocket(addr.Name, opts); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
@@ -0,0 +1,159 @@
+package unix
+
+import (
+	"io"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/azhai/gozzo-net/network"
+)
+
+// 影子连接默认最多积压的数据块
+const DefaultMirrorQueue = 256
+
+// 流量镜像：像RelayData一样转发到主后端，同时把客户端上行的数据异步复制到影子后端
+// 影子后端的回应被丢弃；影子后端慢或者连不上时，丢掉这一路镜像，不影响主路径
+// QueueSize: 每个影子连接最多积压的数据块，积压满了就放弃这个影子连接
+// WriteTimeout: 写影子连接的超时
+// Options: 主路径的转发参数
+type Mirror struct {
+	Shadows      []*Relayer
+	QueueSize    int
+	WriteTimeout time.Duration
+	Options      RelayOptions
+	mirrored     int64
+	dropped      int64
+}
+
+// 创建流量镜像，Relay方法就是ProxyAction
+func NewMirror(shadows ...*Relayer) *Mirror {
+	return &Mirror{
+		Shadows:      shadows,
+		QueueSize:    DefaultMirrorQueue,
+		WriteTimeout: 5 * time.Second,
+		Options:      DefaultRelayOptions,
+	}
+}
+
+// 完整复制到影子后端的连接数
+func (m *Mirror) Mirrored() int {
+	return int(atomic.LoadInt64(&m.mirrored))
+}
+
+// 中途放弃的影子连接数
+func (m *Mirror) Dropped() int {
+	return int(atomic.LoadInt64(&m.dropped))
+}
+
+// 转发并镜像，签名与ProxyAction相同
+func (m *Mirror) Relay(s *network.Server, orig, relay *network.Conn) {
+	var shadows []*shadowConn
+	for _, r := range m.Shadows {
+		shadows = append(shadows, m.openShadow(r))
+	}
+	defer func() {
+		for _, sc := range shadows {
+			sc.finish()
+		}
+	}()
+	dst := &teeWriter{dst: relay.GetRawConn(), shadows: shadows}
+	result := relayTo(orig, relay, dst, orig.GetRawConn(), m.Options)
+	relay.Close()
+	if m.Options.Finished != nil {
+		m.Options.Finished(s, orig, relay, result)
+	}
+}
+
+// 上行数据写入主后端前，先放入各影子连接的队列
+type teeWriter struct {
+	dst     io.Writer
+	shadows []*shadowConn
+}
+
+func (w *teeWriter) Write(p []byte) (int, error) {
+	for _, sc := range w.shadows {
+		sc.push(p)
+	}
+	return w.dst.Write(p)
+}
+
+// 一路影子连接，在自己的goroutine中拨号和写入
+type shadowConn struct {
+	mirror *Mirror
+	queue  chan []byte
+	done   chan struct{}
+	once   sync.Once
+}
+
+func (m *Mirror) openShadow(r *Relayer) *shadowConn {
+	size := m.QueueSize
+	if size <= 0 {
+		size = DefaultMirrorQueue
+	}
+	sc := &shadowConn{
+		mirror: m,
+		queue:  make(chan []byte, size),
+		done:   make(chan struct{}),
+	}
+	go sc.run(r)
+	return sc
+}
+
+func (sc *shadowConn) run(r *Relayer) {
+	conn, err := r.Dial(r.Kind)
+	if err != nil {
+		sc.drop()
+		return
+	}
+	defer conn.Close()
+	go io.Copy(ioutil.Discard, conn) // 丢弃影子后端的回应
+	for {
+		select {
+		case <-sc.done:
+			return
+		case data, ok := <-sc.queue:
+			if !ok { // 客户端的数据已经全部写完
+				atomic.AddInt64(&sc.mirror.mirrored, 1)
+				closeWrite(conn)
+				return
+			}
+			conn.SetWriteDeadline(time.Now().Add(sc.mirror.WriteTimeout))
+			if _, err = conn.Write(data); err != nil {
+				sc.drop()
+				return
+			}
+		}
+	}
+}
+
+// 复制一份放入队列，队列满时放弃，绝不阻塞
+func (sc *shadowConn) push(p []byte) {
+	select {
+	case <-sc.done:
+		return
+	default:
+	}
+	data := make([]byte, len(p))
+	copy(data, p)
+	select {
+	case sc.queue <- data:
+	default:
+		sc.drop() // 数据不完整的镜像没有意义
+	}
+}
+
+// 放弃这一路镜像
+func (sc *shadowConn) drop() {
+	sc.once.Do(func() {
+		atomic.AddInt64(&sc.mirror.dropped, 1)
+		close(sc.done)
+	})
+}
+
+// 上行结束，影子连接写完队列中的数据后关闭
+// 只在所有push之后调用
+func (sc *shadowConn) finish() {
+	close(sc.queue)
+}
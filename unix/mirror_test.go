@@ -0,0 +1,129 @@
+package unix
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/azhai/gozzo-net/network"
+)
+
+// 收下所有数据的影子后端
+func captureBackend(t *testing.T) (net.Listener, chan []byte) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	captured := make(chan []byte, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("ignored reply"))
+		data, _ := ioutil.ReadAll(conn)
+		captured <- data
+	}()
+	return ln, captured
+}
+
+// 不读数据的影子后端
+func stalledBackend(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		var conns []net.Conn // 保持连接，但从不读取
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				break
+			}
+			conns = append(conns, conn)
+		}
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	return ln
+}
+
+func runMirrorProxy(t *testing.T, primary net.Addr, mirror *Mirror) string {
+	addr := deadAddr(t)
+	proxy := NewProxy("tcp", "127.0.0.1", uint16(addr.Port))
+	ready := make(chan bool)
+	events := network.Events{
+		Serving: func(s *network.Server) { ready <- true },
+		Process: proxy.CreateProcess(NewRelayer(primary), mirror.Relay),
+	}
+	go proxy.Run(events)
+	<-ready
+	return addr.String()
+}
+
+func TestMirror(t *testing.T) {
+	primary := tcpEchoBackend(t, "127.0.0.1:0")
+	defer primary.Close()
+	shadow, captured := captureBackend(t)
+	defer shadow.Close()
+	mirror := NewMirror(NewRelayer(shadow.Addr()), NewRelayer(deadAddr(t)))
+	address := runMirrorProxy(t, primary.Addr(), mirror)
+
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	reader := bufio.NewReader(conn)
+	for _, word := range []string{"hello\n", "world\n"} {
+		conn.Write([]byte(word))
+		if line, err := reader.ReadString('\n'); err != nil || line != word {
+			t.Fatalf("primary replied %q, %v", line, err)
+		}
+	}
+	conn.Close()
+
+	select {
+	case data := <-captured:
+		if string(data) != "hello\nworld\n" {
+			t.Fatalf("shadow got %q", data)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("shadow got nothing")
+	}
+	if mirror.Mirrored() != 1 || mirror.Dropped() != 1 {
+		t.Fatalf("mirrored %d, dropped %d", mirror.Mirrored(), mirror.Dropped())
+	}
+}
+
+func TestMirrorStalledShadow(t *testing.T) {
+	primary := tcpEchoBackend(t, "127.0.0.1:0")
+	defer primary.Close()
+	shadow := stalledBackend(t)
+	defer shadow.Close()
+	mirror := NewMirror(NewRelayer(shadow.Addr()))
+	mirror.QueueSize = 1
+	address := runMirrorProxy(t, primary.Addr(), mirror)
+
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	// 远超过内核缓冲，影子后端不读时主路径也不能卡住
+	payload := bytes.Repeat([]byte("0123456789abcdef"), 1<<20)
+	go conn.Write(payload)
+	if _, err = io.CopyN(ioutil.Discard, conn, int64(len(payload))); err != nil {
+		t.Fatal(err)
+	}
+	if mirror.Dropped() != 1 {
+		t.Fatalf("dropped %d", mirror.Dropped())
+	}
+}
@@ -0,0 +1,116 @@
+package unix
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// 目标地址不在允许的范围内
+var ErrForbidden = fmt.Errorf("Destination is forbidden")
+
+// 前端代理的目标访问策略
+// 规则可以是*、IP、CIDR或域名（*.example.com匹配所有子域名），后面可以加上:port限定端口
+// 先检查Deny，Allow为空时允许其余所有目标，否则只允许匹配Allow的目标
+// 域名先解析，解析出的IP也要符合策略，以免用域名绕过CIDR规则
+type AccessPolicy struct {
+	Allow []string `toml:"allow"`
+	Deny  []string `toml:"deny"`
+}
+
+// 解析域名，测试时可以替换
+var lookupIP = net.LookupIP
+
+// 检查目标是否允许访问，host为域名时ips是它解析出的地址，每一个地址都要符合策略
+// 策略为nil时允许所有目标
+func (ap *AccessPolicy) Permit(host string, ips []net.IP, port int) bool {
+	if ap == nil {
+		return true
+	}
+	if len(ips) == 0 {
+		return ap.permit(host, nil, port)
+	}
+	return len(ap.Filter(host, ips, port)) == len(ips)
+}
+
+// 逐个检查解析出的地址，只留下符合策略的
+// 以免域名同时解析到允许的地址和内部地址时，连接到内部地址
+func (ap *AccessPolicy) Filter(host string, ips []net.IP, port int) []net.IP {
+	if ap == nil {
+		return ips
+	}
+	var result []net.IP
+	for _, ip := range ips {
+		if ap.permit(host, []net.IP{ip}, port) {
+			result = append(result, ip)
+		}
+	}
+	return result
+}
+
+func (ap *AccessPolicy) permit(host string, ips []net.IP, port int) bool {
+	for _, rule := range ap.Deny {
+		if matchRule(rule, host, ips, port) {
+			return false
+		}
+	}
+	if len(ap.Allow) == 0 {
+		return true
+	}
+	for _, rule := range ap.Allow {
+		if matchRule(rule, host, ips, port) {
+			return true
+		}
+	}
+	return false
+}
+
+// 解析目标并检查策略，得到要连接的地址，只会是符合策略的地址之一
+func (ap *AccessPolicy) Resolve(host string, port int) (*net.TCPAddr, error) {
+	var ips []net.IP
+	name := host
+	if ip := net.ParseIP(host); ip != nil {
+		ips, name = []net.IP{ip}, ""
+	} else if addrs, err := lookupIP(host); err != nil {
+		return nil, err
+	} else {
+		ips = addrs
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("No address for %s", host)
+	}
+	if ips = ap.Filter(name, ips, port); len(ips) == 0 {
+		return nil, ErrForbidden
+	}
+	return &net.TCPAddr{IP: ips[0], Port: port}, nil
+}
+
+// 匹配一条规则，域名规则只匹配域名，IP和CIDR规则匹配任意一个给出的地址
+func matchRule(rule, host string, ips []net.IP, port int) bool {
+	if h, p, err := net.SplitHostPort(rule); err == nil {
+		if p != strconv.Itoa(port) {
+			return false
+		}
+		rule = h
+	}
+	if rule == "*" {
+		return true
+	}
+	if _, cidr, err := net.ParseCIDR(rule); err == nil {
+		for _, ip := range ips {
+			if cidr.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	if target := net.ParseIP(rule); target != nil {
+		for _, ip := range ips {
+			if target.Equal(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	return MatchDomain(rule, host)
+}
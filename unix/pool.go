@@ -0,0 +1,337 @@
+package unix
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/azhai/gozzo-net/network"
+)
+
+// 连接池参数
+// MinIdle: 平时保持的空闲连接数，MaxIdle: 取不到连接时逐步增加，最多保持的空闲连接数
+// MaxAge: 空闲连接的最长存活时间，超过后关闭，为0时不限
+// Interval: 后台检查过期和补充连接的间隔
+type PoolOptions struct {
+	MinIdle  int
+	MaxIdle  int
+	MaxAge   time.Duration
+	Interval time.Duration
+}
+
+var DefaultPoolOptions = PoolOptions{
+	MinIdle:  2,
+	MaxIdle:  8,
+	MaxAge:   30 * time.Second,
+	Interval: 5 * time.Second,
+}
+
+// 交出连接前检查存活的等待时间
+const poolProbeWait = time.Millisecond
+
+// 拨号得到后端连接
+type DialFunc func(kind string, dp *network.DialPlan) (*network.Conn, error)
+
+// 可以判断后端是否可用的路由，连接池不为不可用或已删除的后端补充连接
+type IUsable interface {
+	IsUsable(kind string, dp *network.DialPlan) bool
+}
+
+// 预先拨号的后端连接池，每个后端地址一组空闲连接
+// 转发过的连接不再放回，池中只有新拨号的连接，由后台补充
+// 一组连接超过MaxAge和10个Interval都没有被取用，停止补充并关闭
+type ConnPool struct {
+	PoolOptions
+	dial   DialFunc
+	usable IUsable
+	plans  map[string]*planPool
+	mutex  sync.Mutex
+	stop   chan struct{}
+	hits   int64
+	misses int64
+}
+
+func NewConnPool(opts PoolOptions, dial DialFunc) *ConnPool {
+	return &ConnPool{
+		PoolOptions: opts,
+		dial:        dial,
+		plans:       make(map[string]*planPool),
+		stop:        make(chan struct{}),
+	}
+}
+
+// 为代理启用连接池，使用代理的客户端参数拨号
+func (p *Proxy) EnablePool(opts PoolOptions) *ConnPool {
+	p.Pool = NewConnPool(opts, func(kind string, dp *network.DialPlan) (*network.Conn, error) {
+		client := p.CreateClient(kind, dp)
+		if client == nil {
+			return nil, ErrNoBackend
+		}
+		return client.Dialing()
+	})
+	return p.Pool
+}
+
+// 按路由的健康检查决定是否补充连接，CreateProcess会设置为代理的路由
+func (cp *ConnPool) Follow(router IRouter) {
+	u, _ := router.(IUsable)
+	cp.mutex.Lock()
+	cp.usable = u
+	cp.mutex.Unlock()
+}
+
+func (cp *ConnPool) isUsable(kind string, dp *network.DialPlan) bool {
+	cp.mutex.Lock()
+	u := cp.usable
+	cp.mutex.Unlock()
+	return u == nil || u.IsUsable(kind, dp)
+}
+
+// 从池中取到的连接数
+func (cp *ConnPool) Hits() int {
+	return int(atomic.LoadInt64(&cp.hits))
+}
+
+// 池中没有可用连接的次数
+func (cp *ConnPool) Misses() int {
+	return int(atomic.LoadInt64(&cp.misses))
+}
+
+// 预先拨号，不必等到第一次取连接
+func (cp *ConnPool) Warm(kind string, dp *network.DialPlan) {
+	cp.getPlan(kind, dp).wake()
+}
+
+// 取一个存活的连接，没有时返回nil，由调用者自己拨号
+func (cp *ConnPool) Get(kind string, dp *network.DialPlan) *network.Conn {
+	pp := cp.getPlan(kind, dp)
+	if pp == nil {
+		return nil
+	}
+	conn := pp.take()
+	if conn != nil {
+		atomic.AddInt64(&cp.hits, 1)
+	} else {
+		atomic.AddInt64(&cp.misses, 1)
+		pp.grow()
+	}
+	pp.wake()
+	return conn
+}
+
+// 停止补充并关闭所有空闲连接
+func (cp *ConnPool) Close() {
+	cp.mutex.Lock()
+	defer cp.mutex.Unlock()
+	select {
+	case <-cp.stop:
+		return
+	default:
+	}
+	close(cp.stop)
+	for _, pp := range cp.plans {
+		pp.clear()
+	}
+}
+
+// 后端集合更新时DialPlan会换成新的对象，按类型和地址区分
+func (cp *ConnPool) getPlan(kind string, dp *network.DialPlan) *planPool {
+	cp.mutex.Lock()
+	defer cp.mutex.Unlock()
+	select {
+	case <-cp.stop:
+		return nil
+	default:
+	}
+	key := kind + "://" + dp.RemoteAddr.String()
+	pp, ok := cp.plans[key]
+	if !ok {
+		pp = &planPool{pool: cp, key: key, kind: kind, target: cp.MinIdle, refill: make(chan struct{}, 1)}
+		cp.plans[key] = pp
+		go pp.run()
+	}
+	pp.use(dp)
+	return pp
+}
+
+// 删除不再使用的一组连接
+func (cp *ConnPool) drop(pp *planPool) {
+	cp.mutex.Lock()
+	if cp.plans[pp.key] == pp {
+		delete(cp.plans, pp.key)
+	}
+	cp.mutex.Unlock()
+	pp.clear()
+}
+
+type idleConn struct {
+	conn  *network.Conn
+	since time.Time
+}
+
+// 一个后端的空闲连接，target在MinIdle和MaxIdle之间变化
+type planPool struct {
+	pool   *ConnPool
+	key    string
+	kind   string
+	dp     *network.DialPlan // 最近一次取用时的拨号计划
+	used   time.Time
+	idle   []idleConn
+	target int
+	mutex  sync.Mutex
+	refill chan struct{}
+}
+
+func (pp *planPool) use(dp *network.DialPlan) {
+	pp.mutex.Lock()
+	pp.dp, pp.used = dp, time.Now()
+	pp.mutex.Unlock()
+}
+
+// 太久没有被取用，后端可能已经删除
+func (pp *planPool) unused(interval time.Duration) bool {
+	limit := 10 * interval
+	if pp.pool.MaxAge > limit {
+		limit = pp.pool.MaxAge
+	}
+	pp.mutex.Lock()
+	defer pp.mutex.Unlock()
+	return time.Since(pp.used) >= limit
+}
+
+// 取最新的连接，过期的和已断开的关闭后跳过
+func (pp *planPool) take() *network.Conn {
+	for {
+		pp.mutex.Lock()
+		n := len(pp.idle)
+		if n == 0 {
+			pp.mutex.Unlock()
+			return nil
+		}
+		ic := pp.idle[n-1]
+		pp.idle = pp.idle[:n-1]
+		pp.mutex.Unlock()
+		if !pp.expired(ic) && isAlive(ic.conn) {
+			return ic.conn
+		}
+		ic.conn.Close()
+	}
+}
+
+// 取不到连接说明并发超过了空闲数，多保持一些
+func (pp *planPool) grow() {
+	pp.mutex.Lock()
+	if pp.target < pp.pool.MaxIdle {
+		pp.target++
+	}
+	pp.mutex.Unlock()
+}
+
+func (pp *planPool) expired(ic idleConn) bool {
+	return pp.pool.MaxAge > 0 && time.Since(ic.since) >= pp.pool.MaxAge
+}
+
+func (pp *planPool) wake() {
+	select {
+	case pp.refill <- struct{}{}:
+	default:
+	}
+}
+
+func (pp *planPool) run() {
+	interval := pp.pool.Interval
+	if interval <= 0 {
+		interval = DefaultPoolOptions.Interval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-pp.pool.stop:
+			return
+		case <-ticker.C:
+			if pp.unused(interval) {
+				pp.pool.drop(pp)
+				return
+			}
+			pp.evict()
+		case <-pp.refill:
+		}
+		pp.fill()
+	}
+}
+
+// 关闭过期的连接，连接没有被用到，说明不需要那么多，target逐步回落
+func (pp *planPool) evict() {
+	pp.mutex.Lock()
+	var keep []idleConn
+	for _, ic := range pp.idle {
+		if pp.expired(ic) {
+			ic.conn.Close()
+			if pp.target > pp.pool.MinIdle {
+				pp.target--
+			}
+		} else {
+			keep = append(keep, ic)
+		}
+	}
+	pp.idle = keep
+	pp.mutex.Unlock()
+}
+
+// 拨号补足target个空闲连接，失败时等下一次再试，后端不可用时不拨号
+func (pp *planPool) fill() {
+	for {
+		pp.mutex.Lock()
+		short, dp := len(pp.idle) < pp.target, pp.dp
+		pp.mutex.Unlock()
+		if !short || !pp.pool.isUsable(pp.kind, dp) {
+			return
+		}
+		conn, err := pp.pool.dial(pp.kind, dp)
+		if err != nil {
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+		pp.mutex.Lock()
+		select {
+		case <-pp.pool.stop:
+			pp.mutex.Unlock()
+			conn.Close()
+			return
+		default:
+		}
+		pp.idle = append(pp.idle, idleConn{conn: conn, since: time.Now()})
+		pp.mutex.Unlock()
+	}
+}
+
+func (pp *planPool) clear() {
+	pp.mutex.Lock()
+	for _, ic := range pp.idle {
+		ic.conn.Close()
+	}
+	pp.idle = nil
+	pp.mutex.Unlock()
+}
+
+// 对方关闭的连接可以读到EOF，读不到数据的超时说明还连着
+// 后端先发送的数据（如欢迎信息）留在读缓冲中，转发时不会丢失
+func isAlive(c *network.Conn) bool {
+	reader := c.GetReader()
+	if reader.Buffered() > 0 {
+		return true
+	}
+	raw := c.GetRawConn()
+	raw.SetReadDeadline(time.Now().Add(poolProbeWait))
+	_, err := reader.Peek(1)
+	raw.SetReadDeadline(time.Time{})
+	if err == nil {
+		return true
+	}
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
@@ -0,0 +1,183 @@
+package unix
+
+import (
+	"bufio"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/azhai/gozzo-net/network"
+)
+
+// 记录接入次数的回显后端，closing为true时接入后立即关闭
+func acceptingBackend(t *testing.T, accepted *int32, closing *int32) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(accepted, 1)
+			if atomic.LoadInt32(closing) != 0 {
+				conn.Close()
+				continue
+			}
+			go func() {
+				defer conn.Close()
+				line, _ := bufio.NewReader(conn).ReadString('\n')
+				conn.Write([]byte(line))
+			}()
+		}
+	}()
+	return ln
+}
+
+func waitCount(t *testing.T, count *int32, want int32) {
+	for i := 0; i < 100; i++ {
+		if atomic.LoadInt32(count) >= want {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("count %d, want %d", atomic.LoadInt32(count), want)
+}
+
+func testPool(t *testing.T, opts PoolOptions, accepted, closing *int32) (*ConnPool, *network.DialPlan, net.Listener) {
+	backend := acceptingBackend(t, accepted, closing)
+	proxy := NewProxy("tcp", "127.0.0.1", 0)
+	return proxy.EnablePool(opts), NewRelayer(backend.Addr()).DialPlan, backend
+}
+
+func TestConnPool(t *testing.T) {
+	var accepted, closing int32
+	opts := PoolOptions{MinIdle: 2, MaxIdle: 3, Interval: time.Hour}
+	pool, dp, backend := testPool(t, opts, &accepted, &closing)
+	defer backend.Close()
+	defer pool.Close()
+
+	pool.Warm("tcp", dp)
+	waitCount(t, &accepted, 2)
+	time.Sleep(10 * time.Millisecond)
+	conn := pool.Get("tcp", dp)
+	if conn == nil {
+		t.Fatal("no pooled conn")
+	}
+	conn.QuickSend([]byte("ping\n"))
+	if line, err := conn.GetReader().ReadString('\n'); line != "ping\n" {
+		t.Fatalf("got %q, %v", line, err)
+	}
+	conn.Close()
+	waitCount(t, &accepted, 3) // 后台补充
+
+	// 后端关闭的连接不会交出
+	atomic.StoreInt32(&closing, 1)
+	for pool.Get("tcp", dp) != nil { // 取走还连着的
+	}
+	time.Sleep(50 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		if conn = pool.Get("tcp", dp); conn != nil {
+			t.Fatal("got a closed conn")
+		}
+	}
+	if pool.Hits() < 1 || pool.Misses() < 3 {
+		t.Fatalf("hits %d, misses %d", pool.Hits(), pool.Misses())
+	}
+}
+
+func TestConnPoolMaxAge(t *testing.T) {
+	var accepted, closing int32
+	opts := PoolOptions{MinIdle: 1, MaxIdle: 1, MaxAge: 50 * time.Millisecond, Interval: 20 * time.Millisecond}
+	pool, dp, backend := testPool(t, opts, &accepted, &closing)
+	defer backend.Close()
+	pool.Warm("tcp", dp)
+	// 过期的连接被关闭并重新拨号
+	waitCount(t, &accepted, 3)
+	pool.Close()
+	if pool.Get("tcp", dp) != nil {
+		t.Fatal("closed pool returned a conn")
+	}
+}
+
+func TestProxyPool(t *testing.T) {
+	var accepted, closing int32
+	backend := acceptingBackend(t, &accepted, &closing)
+	defer backend.Close()
+	addr := deadAddr(t)
+	proxy := NewProxy("tcp", "127.0.0.1", uint16(addr.Port))
+	relayer := NewRelayer(backend.Addr())
+	pool := proxy.EnablePool(PoolOptions{MinIdle: 1, MaxIdle: 2})
+	defer pool.Close()
+	pool.Warm(relayer.Kind, relayer.DialPlan)
+	waitCount(t, &accepted, 1)
+	time.Sleep(10 * time.Millisecond)
+
+	ready := make(chan bool)
+	events := network.Events{
+		Serving: func(s *network.Server) { ready <- true },
+		Process: proxy.CreateProcess(relayer, RelayData),
+	}
+	go proxy.Run(events)
+	<-ready
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	conn.Write([]byte("hello\n"))
+	if line, err := bufio.NewReader(conn).ReadString('\n'); line != "hello\n" {
+		t.Fatalf("got %q, %v", line, err)
+	}
+	if pool.Hits() != 1 {
+		t.Fatalf("hits %d", pool.Hits())
+	}
+}
+
+// 后端不健康或者已删除时不再补充，长时间不用的一组连接被丢弃
+func TestConnPoolFollow(t *testing.T) {
+	var accepted, closing int32
+	opts := PoolOptions{MinIdle: 1, MaxIdle: 1, Interval: 10 * time.Millisecond}
+	pool, dp, backend := testPool(t, opts, &accepted, &closing)
+	defer backend.Close()
+	defer pool.Close()
+	b := NewRoundRobin(&Backend{Kind: "tcp", DialPlan: dp})
+	pool.Follow(b)
+
+	b.Backends()[0].fail(HealthCheck{MaxFails: 1})
+	pool.Warm("tcp", dp)
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&accepted); n != 0 {
+		t.Fatalf("dialed an unhealthy backend %d times", n)
+	}
+
+	// 恢复后更新后端集合，新的拨号计划和原来的地址相同，共用一组连接
+	b.Backends()[0].succeed(b.Health, false)
+	b.Update(NewBackend(backend.Addr(), 1))
+	pool.Warm("tcp", b.Backends()[0].DialPlan)
+	waitCount(t, &accepted, 1)
+	pool.mutex.Lock()
+	plans := len(pool.plans)
+	pool.mutex.Unlock()
+	if plans != 1 {
+		t.Fatalf("%d plan pools", plans)
+	}
+
+	b.Update()
+	for i := 0; i < 100 && plans > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		pool.mutex.Lock()
+		plans = len(pool.plans)
+		pool.mutex.Unlock()
+	}
+	if plans != 0 {
+		t.Fatal("unused plan pool was not dropped")
+	}
+	if n := atomic.LoadInt32(&accepted); n != 1 {
+		t.Fatalf("dialed a removed backend, %d accepted", n)
+	}
+}
@@ -1,8 +1,8 @@
 package unix
 
 import (
-	"io"
 	"net"
+	"time"
 
 	"github.com/azhai/gozzo-net/network"
 	"github.com/azhai/gozzo-net/tcp"
@@ -13,6 +13,16 @@ type IRouter interface {
 	Dispatch(c *network.Conn) (string, *network.DialPlan)
 }
 
+// 可以接收拨号结果的路由，用于被动健康检查
+type IFeedback interface {
+	Feedback(dp *network.DialPlan, err error)
+}
+
+// 统计后端连接数的路由，只在连接后端成功后调用
+type ITracker interface {
+	Track(c *network.Conn, dp *network.DialPlan)
+}
+
 type Relayer struct {
 	Kind string
 	*network.DialPlan
@@ -29,24 +39,42 @@ func NewUnixRelayer(addr net.Addr) *Relayer {
 	return r
 }
 
+func NewUDPRelayer(addr net.Addr) *Relayer {
+	r := NewRelayer(addr)
+	r.Kind = "udp"
+	return r
+}
+
 func (r *Relayer) Dispatch(c *network.Conn) (string, *network.DialPlan) {
 	return r.Kind, r.DialPlan
 }
 
 type ProxyAction func(s *network.Server, orig, relay *network.Conn)
 
-// 原样复制输入和输出
+// 原样复制输入和输出，UDP等数据报按包转发，参数见DefaultRelayOptions
 func RelayData(s *network.Server, orig, relay *network.Conn) {
-	defer relay.Close()
-	go io.Copy(orig.GetRawConn(), relay.GetReader()) // 复制服务端回应
-	// NOTICE: 与上面一行不能对调，否则无法知道客户端关闭了
-	io.Copy(relay.GetRawConn(), orig.GetReader()) // 复制上报数据
+	DefaultRelayOptions.Action(s, orig, relay)
+}
+
+func isDatagram(c *network.Conn) bool {
+	return c.GetKind() == "udp" || c.IsPacket()
 }
 
 // 转发代理
+// UDP代理为每个客户端地址建立一个上游socket（NAT映射）
+// IdleTimeout: 映射的空闲超时，MaxMappings: 映射个数上限，为0时不限
+// ConnectTimeout: 每次连接后端的超时，ConnectBudget: 连接所有后端的总时间，为0时不限
+// ConnectFailed: 所有后端都连接失败时执行，err为*ConnectError
+// Pool: 预先拨号的后端连接池，为nil时每次都拨号，见EnablePool
 type Proxy struct {
-	kind    string
-	Options network.TCPOptions
+	kind           string
+	Options        network.TCPOptions
+	IdleTimeout    time.Duration
+	MaxMappings    int
+	ConnectTimeout time.Duration
+	ConnectBudget  time.Duration
+	ConnectFailed  func(s *network.Server, c *network.Conn, err error)
+	Pool           *ConnPool
 	*network.Server
 }
 
@@ -54,41 +82,75 @@ type Proxy struct {
 func NewProxy(kind, host string, port uint16) *Proxy {
 	opts := network.DefaultTCPOptions
 	serv := network.NewPortServer(host, port)
-	return &Proxy{kind: kind, Options: opts, Server: serv}
+	return &Proxy{
+		kind:           kind,
+		Options:        opts,
+		IdleTimeout:    udp.DefaultIdleTimeout,
+		ConnectTimeout: DefaultConnectTimeout,
+		ConnectBudget:  DefaultConnectBudget,
+		Server:         serv,
+	}
 }
 
 func (p *Proxy) CreateClient(kind string, dp *network.DialPlan) (client network.IClient) {
 	if dp == nil {
 		return
 	}
-	if kind == "tcp" {
+	switch kind {
+	case "tcp":
 		client = tcp.NewClient(dp, p.Options)
-	} else if kind == "udp" {
+	case "udp":
 		client = udp.NewClient(dp, p.Options.Options)
-	} else { // unix
+	case "unixgram":
+		client = NewGramClient(dp, p.Options.Options)
+	case "unixpacket":
+		client = NewPacketClient(dp, p.Options.Options)
+	default: // unix
 		client = NewClient(dp, p.Options.Options)
 	}
 	return
 }
 
 func (p *Proxy) CreateProcess(router IRouter, action ProxyAction) network.ProcessFunc {
+	if p.Pool != nil {
+		p.Pool.Follow(router)
+	}
 	return func(s *network.Server, c *network.Conn) {
-		// 创建客户端，连接到真正的服务器
-		client := p.CreateClient(router.Dispatch(c))
-		if client == nil {
+		// 创建客户端，连接到真正的服务器，失败时换其他后端，不再等待重试
+		client, err := p.connect(c, router, true)
+		if err != nil {
+			if p.ConnectFailed != nil {
+				p.ConnectFailed(s, c, err)
+			}
 			return
 		}
 		defer client.Close()
-		network.Reconnect(client, true, 3)
 		if conn := client.GetConn(); conn != nil {
 			action(s, c, conn)
 		}
 	}
 }
 
+// 从连接池中取一个连接，包装成客户端
+func (p *Proxy) takePooled(kind string, dp *network.DialPlan) network.IClient {
+	if p.Pool == nil {
+		return nil
+	}
+	conn := p.Pool.Get(kind, dp)
+	if conn == nil {
+		return nil
+	}
+	client := p.CreateClient(kind, dp)
+	client.SetConn(conn)
+	return client
+}
+
 func (p *Proxy) Run(events network.Events) (err error) {
 	if p.kind == "udp" {
-		err = udp.NewServer(p.Server).Run(events)
+		server := udp.NewServer(p.Server)
+		server.IdleTimeout = p.IdleTimeout
+		server.MaxPeers = p.MaxMappings
+		err = server.Run(events)
 	} else {
 		err = tcp.NewServer(p.Server).Run(events)
 	}
@@ -0,0 +1,98 @@
+package unix
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/azhai/gozzo-net/network"
+)
+
+// 回应收到的数据和来源地址，用来确认每个客户端有自己的上游socket
+func udpEchoBackend(t *testing.T) *net.UDPConn {
+	backend, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := backend.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			reply := string(buf[:n]) + " " + addr.String()
+			backend.WriteToUDP([]byte(reply), addr)
+		}
+	}()
+	return backend
+}
+
+// 发出一个包，返回回应，超时返回空串
+func askUDP(t *testing.T, conn *net.UDPConn, word string) string {
+	if _, err := conn.Write([]byte(word)); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return ""
+	}
+	return string(buf[:n])
+}
+
+func TestUDPProxy(t *testing.T) {
+	backend := udpEchoBackend(t)
+	defer backend.Close()
+	probe, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := uint16(probe.LocalAddr().(*net.UDPAddr).Port)
+	probe.Close()
+
+	proxy := NewProxy("udp", "127.0.0.1", port)
+	proxy.IdleTimeout = 300 * time.Millisecond
+	proxy.MaxMappings = 2
+	ready := make(chan bool)
+	events := network.Events{
+		Serving: func(s *network.Server) { ready <- true },
+		Process: proxy.CreateProcess(NewUDPRelayer(backend.LocalAddr()), RelayData),
+	}
+	go proxy.Run(events)
+	<-ready
+
+	addr := network.GetUDPAddr(proxy.Address)
+	clients := make([]*net.UDPConn, 3)
+	for i := range clients {
+		if clients[i], err = net.DialUDP("udp", nil, addr); err != nil {
+			t.Fatal(err)
+		}
+		defer clients[i].Close()
+	}
+
+	// 每个客户端收到自己的回应，且经过不同的上游socket
+	first := askUDP(t, clients[0], "first")
+	second := askUDP(t, clients[1], "second")
+	if !strings.HasPrefix(first, "first ") || !strings.HasPrefix(second, "second ") {
+		t.Fatalf("got %q and %q", first, second)
+	}
+	if strings.Fields(first)[1] == strings.Fields(second)[1] {
+		t.Fatalf("clients share the upstream socket %s", strings.Fields(first)[1])
+	}
+	// 同一客户端复用映射
+	if again := askUDP(t, clients[0], "again"); again != "again "+strings.Fields(first)[1] {
+		t.Fatalf("mapping not reused: %q", again)
+	}
+
+	// 超出映射上限的客户端被丢弃，空闲映射过期后可以接入
+	if third := askUDP(t, clients[2], "third"); third != "" {
+		t.Fatalf("mapping cap exceeded: %q", third)
+	}
+	time.Sleep(1500 * time.Millisecond)
+	if third := askUDP(t, clients[2], "third"); !strings.HasPrefix(third, "third ") {
+		t.Fatalf("got %q after idle mappings expired", third)
+	}
+}
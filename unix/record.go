@@ -0,0 +1,335 @@
+package unix
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/azhai/gozzo-net/network"
+)
+
+// 录制文件的开头，最后一个字节是格式版本
+const CaptureMagic = "GZCAP\x01"
+
+// 录制的方向
+const (
+	CaptureUpstream   byte = 1 // 客户端到后端
+	CaptureDownstream byte = 2 // 后端到客户端
+)
+
+// 单条记录的长度上限，超过时认为文件已损坏
+const maxCaptureRecord = 16 << 20
+
+var ErrBadCapture = fmt.Errorf("Bad capture file")
+
+// 录制文件，每个会话一个
+// 文件头：CaptureMagic、开始时间（纳秒，8字节大端）、客户端地址、后端地址
+// 记录：方向（1字节）、距开始的纳秒数、数据长度、数据，数字都是uvarint，字符串带uvarint长度前缀
+type Capture struct {
+	file   *os.File
+	writer *bufio.Writer
+	start  time.Time
+	mutex  sync.Mutex
+	err    error
+}
+
+func CreateCapture(filename string, start time.Time, client, backend string) (*Capture, error) {
+	file, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	cp := &Capture{file: file, writer: bufio.NewWriter(file), start: start}
+	if err = cp.writeHeader(client, backend); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return cp, nil
+}
+
+// 写文件头并立即Flush，文件不能写时在创建时就报错
+func (cp *Capture) writeHeader(client, backend string) error {
+	if _, err := cp.writer.WriteString(CaptureMagic); err != nil {
+		return err
+	}
+	var stamp [8]byte
+	binary.BigEndian.PutUint64(stamp[:], uint64(cp.start.UnixNano()))
+	if _, err := cp.writer.Write(stamp[:]); err != nil {
+		return err
+	}
+	if err := cp.writeString(client); err != nil {
+		return err
+	}
+	if err := cp.writeString(backend); err != nil {
+		return err
+	}
+	return cp.writer.Flush()
+}
+
+func (cp *Capture) writeUvarint(x uint64) error {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], x)
+	_, err := cp.writer.Write(buf[:n])
+	return err
+}
+
+func (cp *Capture) writeString(s string) error {
+	if err := cp.writeUvarint(uint64(len(s))); err != nil {
+		return err
+	}
+	_, err := cp.writer.WriteString(s)
+	return err
+}
+
+// 写一条记录，出错后不再写入，错误由Close返回
+func (cp *Capture) Record(dir byte, data []byte) error {
+	cp.mutex.Lock()
+	defer cp.mutex.Unlock()
+	if cp.err != nil {
+		return cp.err
+	}
+	if cp.err = cp.writer.WriteByte(dir); cp.err != nil {
+		return cp.err
+	}
+	if cp.err = cp.writeUvarint(uint64(time.Since(cp.start))); cp.err != nil {
+		return cp.err
+	}
+	if cp.err = cp.writeUvarint(uint64(len(data))); cp.err != nil {
+		return cp.err
+	}
+	_, cp.err = cp.writer.Write(data)
+	return cp.err
+}
+
+func (cp *Capture) Close() error {
+	cp.mutex.Lock()
+	defer cp.mutex.Unlock()
+	err := cp.writer.Flush()
+	if cerr := cp.file.Close(); err == nil {
+		err = cerr
+	}
+	if cp.err == nil {
+		cp.err = err
+	}
+	return cp.err
+}
+
+// 一条记录，Offset为距会话开始的时间
+type CaptureRecord struct {
+	Dir    byte
+	Offset time.Duration
+	Data   []byte
+}
+
+// 读取录制文件
+type CaptureReader struct {
+	Start   time.Time
+	Client  string
+	Backend string
+	file    *os.File
+	reader  *bufio.Reader
+}
+
+func OpenCapture(filename string) (*CaptureReader, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	cr := &CaptureReader{file: file, reader: bufio.NewReader(file)}
+	if err = cr.readHeader(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return cr, nil
+}
+
+func (cr *CaptureReader) readHeader() error {
+	head := make([]byte, len(CaptureMagic)+8)
+	if _, err := io.ReadFull(cr.reader, head); err != nil || string(head[:len(CaptureMagic)]) != CaptureMagic {
+		return ErrBadCapture
+	}
+	cr.Start = time.Unix(0, int64(binary.BigEndian.Uint64(head[len(CaptureMagic):])))
+	var err error
+	if cr.Client, err = cr.readString(); err == nil {
+		cr.Backend, err = cr.readString()
+	}
+	return err
+}
+
+func (cr *CaptureReader) readBytes() ([]byte, error) {
+	size, err := binary.ReadUvarint(cr.reader)
+	if err != nil {
+		return nil, err
+	}
+	if size > maxCaptureRecord {
+		return nil, ErrBadCapture
+	}
+	data := make([]byte, size)
+	_, err = io.ReadFull(cr.reader, data)
+	return data, err
+}
+
+func (cr *CaptureReader) readString() (string, error) {
+	data, err := cr.readBytes()
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return string(data), err
+}
+
+// 下一条记录，读完时返回io.EOF
+func (cr *CaptureReader) Next() (*CaptureRecord, error) {
+	dir, err := cr.reader.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if dir != CaptureUpstream && dir != CaptureDownstream {
+		return nil, ErrBadCapture
+	}
+	offset, err := binary.ReadUvarint(cr.reader)
+	if err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	data, err := cr.readBytes()
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &CaptureRecord{Dir: dir, Offset: time.Duration(offset), Data: data}, nil
+}
+
+func (cr *CaptureReader) Close() error {
+	return cr.file.Close()
+}
+
+// 录制转发的会话，每个会话写一个录制文件到Dir目录
+// 录制文件创建失败时照常转发，不影响客户端，失败的原因交给Failed
+type Recorder struct {
+	Dir     string
+	Options RelayOptions
+	Failed  func(s *network.Server, orig *network.Conn, err error)
+	seq     int64
+}
+
+func NewRecorder(dir string) *Recorder {
+	return &Recorder{Dir: dir, Options: DefaultRelayOptions}
+}
+
+// 转发并录制，签名与ProxyAction相同
+func (r *Recorder) Relay(s *network.Server, orig, relay *network.Conn) {
+	upstream, downstream := io.Writer(relay.GetRawConn()), io.Writer(orig.GetRawConn())
+	if cp, err := r.create(orig, relay); err == nil {
+		defer cp.Close()
+		upstream = &captureWriter{dst: upstream, capture: cp, dir: CaptureUpstream}
+		downstream = &captureWriter{dst: downstream, capture: cp, dir: CaptureDownstream}
+	} else if r.Failed != nil {
+		r.Failed(s, orig, err)
+	}
+	result := relayTo(orig, relay, upstream, downstream, r.Options)
+	relay.Close()
+	if r.Options.Finished != nil {
+		r.Options.Finished(s, orig, relay, result)
+	}
+}
+
+// 文件名为开始时间加序号
+func (r *Recorder) create(orig, relay *network.Conn) (*Capture, error) {
+	if err := os.MkdirAll(r.Dir, 0755); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	seq := atomic.AddInt64(&r.seq, 1)
+	name := fmt.Sprintf("%s-%06d.gzcap", start.Format("20060102-150405"), seq)
+	return CreateCapture(filepath.Join(r.Dir, name), start,
+		addrString(orig.GetRemoteAddr()), addrString(relay.GetRemoteAddr()))
+}
+
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
+// 写入之后记录，只记录对方真正收到的部分
+type captureWriter struct {
+	dst     io.Writer
+	capture *Capture
+	dir     byte
+}
+
+func (w *captureWriter) Write(p []byte) (int, error) {
+	n, err := w.dst.Write(p)
+	if n > 0 {
+		w.capture.Record(w.dir, p[:n])
+	}
+	return n, err
+}
+
+// 回放参数
+// Dir: 回放哪个方向，CaptureUpstream向后端回放客户端，CaptureDownstream向客户端回放后端
+// Realtime: 按录制时的时间间隔发送，否则尽快发送
+// Output: 对方的回应写到这里，为nil时丢弃
+// Wait: 发完后等待对方关闭的最长时间，为0时一直等
+type ReplayOptions struct {
+	Dir      byte
+	Realtime bool
+	Output   io.Writer
+	Wait     time.Duration
+}
+
+// 把录制的一个方向发送给conn，发完后关闭写，等对方关闭连接
+// 等待超过Wait时不再读取对方的回应，不算出错
+func Replay(cr *CaptureReader, conn net.Conn, opts ReplayOptions) (sent int64, err error) {
+	output := opts.Output
+	if output == nil {
+		output = ioutil.Discard
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(output, conn)
+		done <- err
+	}()
+	start := time.Now()
+	for {
+		var rec *CaptureRecord
+		if rec, err = cr.Next(); err != nil {
+			break
+		}
+		if rec.Dir != opts.Dir {
+			continue
+		}
+		if opts.Realtime {
+			if wait := rec.Offset - time.Since(start); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+		var n int
+		n, err = conn.Write(rec.Data)
+		sent += int64(n)
+		if err != nil {
+			return
+		}
+	}
+	if err != io.EOF {
+		return
+	}
+	closeWrite(conn)
+	if opts.Wait > 0 {
+		conn.SetReadDeadline(time.Now().Add(opts.Wait))
+	}
+	err = <-done
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() && opts.Wait > 0 {
+		err = nil
+	}
+	return sent, err
+}
@@ -0,0 +1,273 @@
+package unix
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/azhai/gozzo-net/network"
+)
+
+// 经过录制代理发送两行，中间间隔gap，返回录制文件
+func recordSession(t *testing.T, dir string, backend net.Addr, gap time.Duration) string {
+	addr := deadAddr(t)
+	proxy := NewProxy("tcp", "127.0.0.1", uint16(addr.Port))
+	recorder := NewRecorder(dir)
+	finished := make(chan bool, 1)
+	recorder.Options.Finished = func(s *network.Server, orig, relay *network.Conn, result *RelayResult) {
+		finished <- true
+	}
+	ready := make(chan bool)
+	events := network.Events{
+		Serving: func(s *network.Server) { ready <- true },
+		Process: proxy.CreateProcess(NewRelayer(backend), recorder.Relay),
+	}
+	go proxy.Run(events)
+	<-ready
+
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	reader := bufio.NewReader(conn)
+	for i, word := range []string{"hello\n", "world\n"} {
+		if i > 0 {
+			time.Sleep(gap)
+		}
+		conn.Write([]byte(word))
+		if line, err := reader.ReadString('\n'); line != word {
+			t.Fatalf("got %q, %v", line, err)
+		}
+	}
+	conn.Close()
+	select {
+	case <-finished:
+	case <-time.After(3 * time.Second):
+		t.Fatal("session did not finish")
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*.gzcap"))
+	if len(files) != 1 {
+		t.Fatalf("found %d capture files", len(files))
+	}
+	return files[0]
+}
+
+func TestRecordReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gozzo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	backend := tcpEchoBackend(t, "127.0.0.1:0")
+	defer backend.Close()
+	gap := 100 * time.Millisecond
+	filename := recordSession(t, dir, backend.Addr(), gap)
+
+	cr, err := OpenCapture(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cr.Backend != backend.Addr().String() || cr.Client == "" {
+		t.Fatalf("header client=%s backend=%s", cr.Client, cr.Backend)
+	}
+	var got []string
+	var last time.Duration
+	for {
+		rec, err := cr.Next()
+		if err != nil {
+			break
+		}
+		if rec.Offset < last {
+			t.Fatal("offsets go backwards")
+		}
+		last = rec.Offset
+		got = append(got, fmt.Sprintf("%d%s", rec.Dir, rec.Data))
+	}
+	cr.Close()
+	want := []string{"1hello\n", "2hello\n", "1world\n", "2world\n"}
+	if len(got) != len(want) {
+		t.Fatalf("records %q", got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("records %q", got)
+		}
+	}
+	if last < gap {
+		t.Fatalf("last record at %s", last)
+	}
+
+	// 按原来的时间间隔向后端回放客户端
+	for _, realtime := range []bool{false, true} {
+		cr, err = OpenCapture(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := net.Dial("tcp", backend.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(3 * time.Second))
+		var output bytes.Buffer
+		start := time.Now()
+		opts := ReplayOptions{Dir: CaptureUpstream, Realtime: realtime, Output: &output}
+		sent, err := Replay(cr, conn, opts)
+		elapsed := time.Since(start)
+		conn.Close()
+		cr.Close()
+		if err != nil || sent != 12 || output.String() != "hello\nworld\n" {
+			t.Fatalf("sent %d, got %q, %v", sent, output.String(), err)
+		}
+		if realtime != (elapsed >= gap) {
+			t.Fatalf("realtime=%v replay took %s", realtime, elapsed)
+		}
+	}
+}
+
+func TestBadCapture(t *testing.T) {
+	file, err := ioutil.TempFile("", "gozzo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("not a capture")
+	file.Close()
+	if _, err = OpenCapture(file.Name()); err != ErrBadCapture {
+		t.Fatalf("got %v", err)
+	}
+}
+
+// 只写出了一部分时，录制的也只有这一部分
+type shortWriter struct{}
+
+func (w shortWriter) Write(p []byte) (int, error) {
+	return 3, io.ErrShortWrite
+}
+
+func TestCaptureWritten(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gozzo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "short.gzcap")
+	cp, err := CreateCapture(filename, time.Now(), "client", "backend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &captureWriter{dst: shortWriter{}, capture: cp, dir: CaptureUpstream}
+	if n, err := w.Write([]byte("hello")); n != 3 || err != io.ErrShortWrite {
+		t.Fatalf("wrote %d, %v", n, err)
+	}
+	cp.Close()
+	cr, err := OpenCapture(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cr.Close()
+	if rec, err := cr.Next(); err != nil || string(rec.Data) != "hel" {
+		t.Fatalf("recorded %v, %v", rec, err)
+	}
+}
+
+// 录制目录不能创建时照常转发，并报告错误
+func TestRecordFailed(t *testing.T) {
+	file, err := ioutil.TempFile("", "gozzo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+	backend := tcpEchoBackend(t, "127.0.0.1:0")
+	defer backend.Close()
+
+	addr := deadAddr(t)
+	proxy := NewProxy("tcp", "127.0.0.1", uint16(addr.Port))
+	recorder := NewRecorder(filepath.Join(file.Name(), "captures")) // 上级是普通文件
+	failures := make(chan error, 1)
+	recorder.Failed = func(s *network.Server, orig *network.Conn, err error) {
+		failures <- err
+	}
+	ready := make(chan bool)
+	events := network.Events{
+		Serving: func(s *network.Server) { ready <- true },
+		Process: proxy.CreateProcess(NewRelayer(backend.Addr()), recorder.Relay),
+	}
+	go proxy.Run(events)
+	<-ready
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	conn.Write([]byte("hello\n"))
+	if line, err := bufio.NewReader(conn).ReadString('\n'); line != "hello\n" {
+		t.Fatalf("got %q, %v", line, err)
+	}
+	select {
+	case err = <-failures:
+		if err == nil {
+			t.Fatal("nil error reported")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("failure was not reported")
+	}
+}
+
+// 对方一直不关闭时，最多等待Wait
+func TestReplayWait(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gozzo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "wait.gzcap")
+	cp, err := CreateCapture(filename, time.Now(), "client", "backend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp.Record(CaptureUpstream, []byte("hello"))
+	cp.Close()
+	cr, err := OpenCapture(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cr.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	hold := make(chan bool)
+	defer close(hold)
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			defer conn.Close()
+			io.Copy(ioutil.Discard, conn) // 读完也不关闭，直到测试结束
+			<-hold
+		}
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	start := time.Now()
+	opts := ReplayOptions{Dir: CaptureUpstream, Wait: 200 * time.Millisecond}
+	if sent, err := Replay(cr, conn, opts); sent != 5 || err != nil {
+		t.Fatalf("sent %d, %v", sent, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("waited %s for the peer", elapsed)
+	}
+}
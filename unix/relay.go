@@ -0,0 +1,259 @@
+package unix
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/azhai/gozzo-net/network"
+	"github.com/azhai/gozzo-net/udp"
+)
+
+// 两个方向都没有数据超过IdleTimeout
+var ErrIdleTimeout = fmt.Errorf("Relay idle timeout")
+
+// 转发参数
+// IdleTimeout: 两个方向都没有数据多久后断开，为0时不限
+// Splice: 两端都是TCP时直接在原始连接间复制，Linux下使用splice零拷贝
+// Finished: 转发结束后执行，可用于记录日志
+type RelayOptions struct {
+	IdleTimeout time.Duration
+	Splice      bool
+	Finished    func(s *network.Server, orig, relay *network.Conn, result *RelayResult)
+}
+
+// RelayData使用的参数，默认不限空闲时间，长连接的设备可能很久才发一次数据
+// 半关闭后对方一直不关闭时转发不会结束，需要时设置IdleTimeout
+var DefaultRelayOptions = RelayOptions{}
+
+// 转发结果，Upstream为客户端到后端，Downstream为后端到客户端
+// FirstClosed: 先结束的一方，client或backend
+type RelayResult struct {
+	Upstream      int64
+	Downstream    int64
+	UpstreamErr   error
+	DownstreamErr error
+	FirstClosed   string
+	Duration      time.Duration
+}
+
+func (r *RelayResult) String() string {
+	return fmt.Sprintf("up=%d down=%d first_closed=%s duration=%s up_err=%v down_err=%v",
+		r.Upstream, r.Downstream, r.FirstClosed, r.Duration, r.UpstreamErr, r.DownstreamErr)
+}
+
+// 使用splice的转发，其他参数同DefaultRelayOptions
+func SpliceData(s *network.Server, orig, relay *network.Conn) {
+	opts := DefaultRelayOptions
+	opts.Splice = true
+	opts.Action(s, orig, relay)
+}
+
+// 作为ProxyAction，转发结束后关闭relay并执行Finished
+func (opts RelayOptions) Action(s *network.Server, orig, relay *network.Conn) {
+	result := Relay(orig, relay, opts)
+	relay.Close()
+	if opts.Finished != nil {
+		opts.Finished(s, orig, relay, result)
+	}
+}
+
+// 双向转发，直到两个方向都结束
+// 一方写完时向另一方CloseWrite，另一方向的数据仍然转发完整
+// 一个方向出错或空闲超时时，两个方向都停止
+// UDP等数据报逐个转发，保留包的边界
+func Relay(orig, relay *network.Conn, opts RelayOptions) *RelayResult {
+	return relayTo(orig, relay, relay.GetRawConn(), orig.GetRawConn(), opts)
+}
+
+// 上行数据写入upstream，下行数据写入downstream，用于镜像、录制等需要旁路数据的场合
+func relayTo(orig, relay *network.Conn, upstream, downstream io.Writer, opts RelayOptions) *RelayResult {
+	result := new(RelayResult)
+	start := time.Now()
+	st := &relayState{idle: opts.IdleTimeout, packet: isDatagram(orig) || isDatagram(relay)}
+	st.touch()
+	origRaw, relayRaw := orig.GetRawConn(), relay.GetRawConn()
+	copier := st.copy
+	if opts.Splice && canSplice(upstream, downstream, origRaw, relayRaw) {
+		copier = st.splice
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		result.Upstream, result.UpstreamErr = copier(upstream, orig.GetReader(), origRaw)
+		if result.UpstreamErr == nil {
+			result.UpstreamErr = flushWriter(upstream)
+		}
+		st.finish("client", result.UpstreamErr, relayRaw)
+	}()
+	result.Downstream, result.DownstreamErr = copier(downstream, relay.GetReader(), relayRaw)
+	if result.DownstreamErr == nil {
+		result.DownstreamErr = flushWriter(downstream)
+	}
+	st.finish("backend", result.DownstreamErr, origRaw)
+	<-done
+
+	result.FirstClosed = st.first
+	result.Duration = time.Since(start)
+	return result
+}
+
+// 转发过程中两个方向共享的状态
+type relayState struct {
+	idle    time.Duration
+	packet  bool
+	last    int64 // 最近一次读到数据的时间戳（纳秒）
+	aborted int32
+	first   string
+	mutex   sync.Mutex
+}
+
+func (st *relayState) touch() {
+	atomic.StoreInt64(&st.last, time.Now().UnixNano())
+}
+
+func (st *relayState) isIdle() bool {
+	last := atomic.LoadInt64(&st.last)
+	return time.Since(time.Unix(0, last)) >= st.idle
+}
+
+func (st *relayState) isAborted() bool {
+	return atomic.LoadInt32(&st.aborted) != 0
+}
+
+// 一个方向结束：正常结束时关闭peer的写，出错时让读peer的另一个方向也停下
+func (st *relayState) finish(side string, err error, peer network.INetConn) {
+	st.mutex.Lock()
+	if st.first == "" {
+		st.first = side
+	}
+	st.mutex.Unlock()
+	if err == nil && !st.packet {
+		closeWrite(peer)
+		return
+	}
+	atomic.StoreInt32(&st.aborted, 1)
+	peer.SetReadDeadline(time.Now())
+}
+
+// 复制一个方向，读到EOF时返回nil，被另一方向中止时也返回nil
+func (st *relayState) copy(dst io.Writer, src io.Reader, raw network.INetConn) (written int64, err error) {
+	size := 32 * 1024
+	if st.packet {
+		size = udp.MaxDatagramSize
+	}
+	buf := make([]byte, size)
+	for {
+		if st.idle > 0 {
+			raw.SetReadDeadline(time.Now().Add(st.idle))
+			if st.isAborted() { // 不能覆盖中止时设置的deadline
+				raw.SetReadDeadline(time.Now())
+			}
+		}
+		n, rerr := src.Read(buf)
+		if n > 0 {
+			st.touch()
+			var m int
+			m, err = dst.Write(buf[:n])
+			written += int64(m)
+			if err != nil && !(st.packet && network.IsTemporaryError(err)) {
+				return
+			}
+			err = nil
+		}
+		if rerr == nil {
+			continue
+		}
+		if st.isAborted() {
+			return written, nil
+		}
+		if netErr, ok := rerr.(net.Error); ok && netErr.Timeout() && st.idle > 0 {
+			if !st.isIdle() {
+				continue // 另一个方向还有数据
+			}
+			return written, ErrIdleTimeout
+		}
+		if rerr == io.EOF {
+			return written, nil
+		}
+		return written, rerr
+	}
+}
+
+// 两个方向都没有旁路，并且两端都是TCP连接
+func canSplice(upstream, downstream io.Writer, origRaw, relayRaw network.INetConn) bool {
+	if upstream != io.Writer(relayRaw) || downstream != io.Writer(origRaw) {
+		return false
+	}
+	_, ok1 := origRaw.(*net.TCPConn)
+	_, ok2 := relayRaw.(*net.TCPConn)
+	return ok1 && ok2
+}
+
+// 每次splice最多复制的字节数，之后检查空闲和中止
+const spliceChunk = 4 << 20
+
+// 先写出读缓冲中已经Peek过的数据，之后在原始连接间复制，让TCPConn.ReadFrom使用splice
+func (st *relayState) splice(dst io.Writer, src io.Reader, raw network.INetConn) (written int64, err error) {
+	if reader, ok := src.(*bufio.Reader); ok && reader.Buffered() > 0 {
+		data, _ := reader.Peek(reader.Buffered())
+		n, werr := dst.Write(data)
+		written += int64(n)
+		reader.Discard(n)
+		if werr != nil {
+			return written, werr
+		}
+		st.touch()
+	}
+	to, from := dst.(*net.TCPConn), raw.(*net.TCPConn)
+	for {
+		if st.idle > 0 {
+			from.SetReadDeadline(time.Now().Add(st.idle))
+			if st.isAborted() {
+				from.SetReadDeadline(time.Now())
+			}
+		}
+		// LimitedReader包装的TCPConn仍然可以splice
+		n, rerr := to.ReadFrom(&io.LimitedReader{R: from, N: spliceChunk})
+		written += n
+		if n > 0 {
+			st.touch()
+		}
+		if rerr == nil {
+			if n < spliceChunk {
+				return written, nil // 读到了EOF
+			}
+			continue
+		}
+		if st.isAborted() {
+			return written, nil
+		}
+		if netErr, ok := rerr.(net.Error); ok && netErr.Timeout() && st.idle > 0 {
+			if n > 0 || !st.isIdle() {
+				continue
+			}
+			return written, ErrIdleTimeout
+		}
+		return written, rerr
+	}
+}
+
+// 旁路的writer可能还有排队的数据（如故障注入的延迟），关闭写之前写完
+func flushWriter(w io.Writer) error {
+	if f, ok := w.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// 关闭写的一端，对方可以读到EOF
+func closeWrite(w io.Writer) {
+	if cw, ok := w.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+}
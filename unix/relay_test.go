@@ -0,0 +1,121 @@
+package unix
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/azhai/gozzo-net/network"
+)
+
+// 读完全部请求后才回应，然后关闭
+func countingBackend(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				data, _ := ioutil.ReadAll(conn)
+				fmt.Fprintf(conn, "got %d bytes", len(data))
+			}()
+		}
+	}()
+	return ln
+}
+
+func runRelayProxy(t *testing.T, backend net.Addr, opts RelayOptions) (string, chan *RelayResult) {
+	results := make(chan *RelayResult, 1)
+	opts.Finished = func(s *network.Server, orig, relay *network.Conn, result *RelayResult) {
+		results <- result
+	}
+	addr := deadAddr(t)
+	proxy := NewProxy("tcp", "127.0.0.1", uint16(addr.Port))
+	ready := make(chan bool)
+	events := network.Events{
+		Serving: func(s *network.Server) { ready <- true },
+		Process: proxy.CreateProcess(NewRelayer(backend), opts.Action),
+	}
+	go proxy.Run(events)
+	<-ready
+	return addr.String(), results
+}
+
+func waitResult(t *testing.T, results chan *RelayResult) *RelayResult {
+	select {
+	case result := <-results:
+		return result
+	case <-time.After(3 * time.Second):
+		t.Fatal("relay did not finish")
+	}
+	return nil
+}
+
+func TestRelayHalfClose(t *testing.T) {
+	backend := countingBackend(t)
+	defer backend.Close()
+	address, results := runRelayProxy(t, backend.Addr(), DefaultRelayOptions)
+
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	conn.Write(make([]byte, 100000))
+	conn.(*net.TCPConn).CloseWrite()
+	// 客户端半关闭后，后端的回应仍然完整
+	reply, err := ioutil.ReadAll(conn)
+	if err != nil || string(reply) != "got 100000 bytes" {
+		t.Fatalf("got %q, %v", reply, err)
+	}
+	result := waitResult(t, results)
+	if result.Upstream != 100000 || result.Downstream != int64(len(reply)) {
+		t.Fatalf("counted %s", result)
+	}
+	if result.FirstClosed != "client" || result.UpstreamErr != nil || result.DownstreamErr != nil {
+		t.Fatalf("result %s", result)
+	}
+}
+
+func TestRelayIdleTimeout(t *testing.T) {
+	backend := tcpEchoBackend(t, "127.0.0.1:0")
+	defer backend.Close()
+	opts := RelayOptions{IdleTimeout: 200 * time.Millisecond}
+	address, results := runRelayProxy(t, backend.Addr(), opts)
+
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	// 有数据往来时不会超时
+	buf := make([]byte, 5)
+	for i := 0; i < 3; i++ {
+		time.Sleep(100 * time.Millisecond)
+		conn.Write([]byte("hello"))
+		if _, err = conn.Read(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	start := time.Now()
+	result := waitResult(t, results)
+	if result.UpstreamErr != ErrIdleTimeout && result.DownstreamErr != ErrIdleTimeout {
+		t.Fatalf("result %s", result)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("idle relay lasted %s", elapsed)
+	}
+	if result.Upstream != 15 || result.Downstream != 15 {
+		t.Fatalf("counted %s", result)
+	}
+}
@@ -7,45 +7,88 @@ import (
 	"net"
 	"os"
 	"runtime"
+	"time"
 
 	"github.com/azhai/gozzo-net/network"
 	"github.com/azhai/gozzo-utils/filesystem"
 )
 
-// Unix socket 服务器
+// Unix socket 服务器，kind为unix或unixpacket
 type UnixServer struct {
-	listener *net.UnixListener
+	kind      string
+	listener  *net.UnixListener
+	activated bool           // 由systemd创建的sock文件，不删除
+	active    network.ActiveConns // 正在处理的连接，平滑升级时等待它们结束
 	*network.Server
 }
 
 // 创建Unix服务器
 func NewServer(server *network.Server) *UnixServer {
-	return &UnixServer{Server: server}
+	return &UnixServer{kind: "unix", Server: server}
+}
+
+// 创建unixpacket服务器，每条消息就是一帧
+func NewPacketServer(server *network.Server) *UnixServer {
+	return &UnixServer{kind: "unixpacket", Server: server}
 }
 
 // 服务启动阶段，执行Tick事件
+// 由平滑升级启动时，使用从父进程继承的监听
+// 由systemd socket activation启动时，使用传入的监听
 func (s *UnixServer) Startup(events network.Events) (err error) {
-	if addr, ok := s.Address.(*net.UnixAddr); ok {
-		s.listener, err = net.ListenUnix("unix", addr)
-		s.listener.SetUnlinkOnClose(true) // 删除sock文件，好像不起作用
-	} else {
-		err = fmt.Errorf("The address is not a UnixAddr object")
+	addr := network.GetUnixAddr(s.Address)
+	if addr == nil {
+		return fmt.Errorf("The address is not a UnixAddr object")
+	}
+	upgrader := network.DefaultUpgrader
+	var ln net.Listener
+	if ln, err = upgrader.Inherit(s.kind, addr.Name); err != nil {
+		return
 	}
-	if err == nil {
-		s.Trigger(events)
+	inherited := ln != nil
+	if !inherited {
+		if ln, err = network.Activated(s.kind, s.ListenName, addr); err != nil {
+			return
+		}
+		s.activated = ln != nil
 	}
+	if ln != nil {
+		var ok bool
+		if s.listener, ok = ln.(*net.UnixListener); !ok {
+			ln.Close()
+			return fmt.Errorf("The listener of %s is not a UnixListener", addr.Name)
+		}
+		if inherited {
+			s.listener.SetUnlinkOnClose(true)
+		}
+	} else {
+		opts := network.GetUnixOptions(s.Address)
+		if s.listener, err = ListenUnix(s.kind, addr, opts); err != nil {
+			return
+		}
+	}
+	upgrader.Register(s.kind, addr.Name, s.listener)
+	s.Trigger(events)
 	return
 }
 
 // 服务停止阶段，关闭每一个网络连接
 func (s *UnixServer) Shutdown(events network.Events) (err error) {
+	filename := s.Server.Address.String()
+	upgraded := network.DefaultUpgrader.IsUpgraded()
 	if s.listener != nil {
+		network.DefaultUpgrader.Unregister(s.kind, filename)
+		if upgraded { // sock文件已交给新进程
+			s.listener.SetUnlinkOnClose(false)
+		}
 		err = s.listener.Close()
 	}
 	s.Cleanup(func(c *network.Conn) error {
 		return s.Finish(events, c)
 	})
-	filename := s.Server.Address.String()
+	if upgraded || s.activated || network.IsAbstractUnix(filename) {
+		return
+	}
 	if _, exists := filesystem.FileSize(filename); exists {
 		err = os.Remove(filename)
 	}
@@ -63,15 +106,47 @@ func (s *UnixServer) Run(events network.Events) (err error) {
 	if events.Serving != nil {
 		events.Serving(s.Server)
 	}
+	// 通知父进程可以交接了，升级后不再接入，等待已有连接结束
+	upgrader := network.DefaultUpgrader
+	upgrader.Ready()
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-upgrader.Upgraded():
+			s.listener.SetDeadline(time.Now())
+		case <-stop:
+		}
+	}()
 	// 循环接收和处理连接
-	var conn *net.UnixConn
+	var (
+		conn    *net.UnixConn
+		backoff network.Backoff
+	)
 	for {
 		conn, err = s.listener.AcceptUnix()
 		if err != nil {
-			continue
+			if upgrader.IsUpgraded() {
+				upgrader.Drain(&s.active)
+				return nil
+			}
+			if network.IsTemporaryError(err) {
+				backoff.Wait()
+				continue
+			}
+			return
 		}
-		c := network.NewUnixConn(conn)
-		s.Execute(events, c)
+		backoff.Reset()
+		var c *network.Conn
+		if s.kind == "unixpacket" {
+			c = network.NewUnixpacketConn(conn)
+		} else {
+			c = network.NewUnixConn(conn)
+		}
+		s.active.Add(c)
+		go func() {
+			defer s.active.Done(c)
+			s.Execute(events, c)
+		}()
 	}
-	return
 }
@@ -0,0 +1,182 @@
+// +build android darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package unix
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/azhai/gozzo-net/network"
+)
+
+func echoEvents(ready chan bool) network.Events {
+	return network.Events{
+		Serving: func(s *network.Server) {
+			ready <- true
+		},
+		Prepare: func(c *network.Conn) (bufio.SplitFunc, network.FilterFunc) {
+			return bufio.ScanLines, nil
+		},
+		Receive: func(c *network.Conn, data []byte, saved bool) (string, error) {
+			return "", c.QuickSend(append(data, '\n'))
+		},
+	}
+}
+
+func TestConcurrentClients(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gozzo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "echo.sock")
+	server := NewServer(network.NewUnixServer(filename))
+	ready := make(chan bool)
+	events := echoEvents(ready)
+	go server.Run(events)
+	defer server.Shutdown(events)
+	<-ready
+
+	// 第一个客户端保持连接，第二个客户端仍然能得到回应
+	first, err := net.Dial("unix", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	for _, word := range []string{"first", "second"} {
+		conn := first
+		if word == "second" {
+			if conn, err = net.Dial("unix", filename); err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+		}
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		conn.Write([]byte(word + "\n"))
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil || line != word+"\n" {
+			t.Fatalf("%s: got %q, %v", word, line, err)
+		}
+	}
+}
+
+func TestStaleSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gozzo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "stale.sock")
+
+	// 模拟进程崩溃后残留的sock文件
+	stale, err := net.ListenUnix("unix", network.NewUnixAddr(filename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	opts := network.DefaultUnixOptions
+	opts.Mode = 0600
+	first := NewServer(network.NewUnixServer(filename, opts))
+	if err = first.Startup(network.Events{}); err != nil {
+		t.Fatal(err)
+	}
+	defer first.Shutdown(network.Events{})
+	if info, err := os.Stat(filename); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("mode of %s: %v, %v", filename, info.Mode(), err)
+	}
+
+	// 有人监听时不能删除
+	second := NewServer(network.NewUnixServer(filename))
+	if err = second.Startup(network.Events{}); err == nil {
+		second.Shutdown(network.Events{})
+		t.Fatal("the socket in use was replaced")
+	}
+}
+
+func TestAbstractSocket(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("abstract namespace is only supported on Linux")
+	}
+	name := "@gozzo-test-" + network.RandomGUID()
+	server := NewServer(network.NewUnixServer(name))
+	ready := make(chan bool)
+	events := echoEvents(ready)
+	go server.Run(events)
+	defer server.Shutdown(events)
+	<-ready
+
+	plan := network.NewDialPlan(nil, nil, 3)
+	plan.SetUnixRemote(name)
+	client := NewClient(plan, network.Options{})
+	defer client.Close()
+	if _, err := network.TrySendData(client, []byte("ping\n"), 1); err != nil {
+		t.Fatal(err)
+	}
+	line, err := client.GetConn().GetReader().ReadString('\n')
+	if err != nil || line != "ping\n" {
+		t.Fatalf("got %q, %v", line, err)
+	}
+}
+
+func TestPeerCred(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("SO_PEERCRED is only supported on Linux")
+	}
+	for _, uid := range []int{os.Getuid(), os.Getuid() + 1} {
+		name := "@gozzo-test-" + network.RandomGUID()
+		server := NewServer(network.NewUnixServer(name))
+		ready := make(chan bool)
+		events := echoEvents(ready)
+		events.Authorize = network.AllowPeers([]int{uid}, nil)
+		go server.Run(events)
+		<-ready
+
+		conn, err := net.Dial("unix", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		conn.Write([]byte("ping\n"))
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if allowed := uid == os.Getuid(); allowed != (err == nil) {
+			t.Fatalf("uid %d: allowed=%v, got %q, %v", uid, allowed, line, err)
+		}
+		conn.Close()
+		server.Shutdown(events)
+	}
+}
+
+// sock文件创建时就是设置的权限，不需要等到chmod
+func TestSocketModeOnCreate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gozzo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "mode.sock")
+	opts := network.DefaultUnixOptions
+	opts.Mode = 0600
+	err = withUmask(filename, opts, func() error {
+		ln, err := net.ListenUnix("unix", network.NewUnixAddr(filename))
+		if err != nil {
+			return err
+		}
+		defer ln.Close()
+		info, err := os.Stat(filename)
+		if err == nil && info.Mode().Perm()&^0600 != 0 {
+			t.Errorf("socket created with mode %v", info.Mode())
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,415 @@
+package unix
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/azhai/gozzo-net/network"
+)
+
+// 等待首包的默认超时
+var DefaultSniffTimeout = 3 * time.Second
+
+// 嗅探规则，条件都为空时匹配所有连接，可作为最后一条默认规则
+// SNI: TLS ClientHello中的域名，Host: HTTP/1的Host头，都支持*.example.com
+// Prefix: 开头的字节
+// Kind: 后端类型，默认为tcp
+// Backends: 后端地址，多个时按Balance负载均衡
+// Balance: roundrobin（默认）, leastconn, twochoices, hash
+type SniffRule struct {
+	SNI      string   `toml:"sni"`
+	Host     string   `toml:"host"`
+	Prefix   string   `toml:"prefix"`
+	Kind     string   `toml:"kind"`
+	Backends []string `toml:"backends"`
+	Balance  string   `toml:"balance"`
+	Router   IRouter  `toml:"-"`
+}
+
+// 嗅探规则的配置文件
+type SniffSetting struct {
+	Timeout int         `toml:"timeout"` // 等待首包的秒数
+	Rules   []SniffRule `toml:"rule"`
+}
+
+// 首包中可以用来路由的信息
+type SniffInfo struct {
+	Data []byte // 已经读到的数据，并未消耗
+	SNI  string
+	Host string
+}
+
+// 按首包内容选择后端的路由，只Peek不消耗数据
+type Sniffer struct {
+	Timeout time.Duration
+	Rules   []*SniffRule
+	matched sync.Map // 每个连接匹配的规则，连接关闭时删除
+}
+
+// 从TOML配置文件创建嗅探路由
+func LoadSniffer(filename string) (*Sniffer, error) {
+	var conf SniffSetting
+	if _, err := toml.DecodeFile(filename, &conf); err != nil {
+		return nil, err
+	}
+	return NewSniffer(conf)
+}
+
+// 按配置创建嗅探路由，为每条规则创建后端路由
+func NewSniffer(conf SniffSetting) (*Sniffer, error) {
+	s := &Sniffer{Timeout: DefaultSniffTimeout}
+	if conf.Timeout > 0 {
+		s.Timeout = time.Duration(conf.Timeout) * time.Second
+	}
+	for i := range conf.Rules {
+		rule := conf.Rules[i]
+		if rule.Router == nil {
+			router, err := rule.CreateRouter()
+			if err != nil {
+				return nil, fmt.Errorf("rule %d: %s", i+1, err)
+			}
+			rule.Router = router
+		}
+		s.Rules = append(s.Rules, &rule)
+	}
+	return s, nil
+}
+
+// 创建规则的后端路由
+func (r *SniffRule) CreateRouter() (IRouter, error) {
+	kind := r.Kind
+	if kind == "" {
+		kind = "tcp"
+	}
+	var backends []*Backend
+	for _, address := range r.Backends {
+		addr, err := resolveAddr(kind, address)
+		if err != nil {
+			return nil, err
+		}
+		backends = append(backends, NewKindBackend(kind, addr, 1))
+	}
+	switch {
+	case len(backends) == 0:
+		return nil, fmt.Errorf("No backends")
+	case len(backends) == 1 && r.Balance == "":
+		return &Relayer{Kind: kind, DialPlan: backends[0].DialPlan}, nil
+	}
+	switch r.Balance {
+	case "", "roundrobin":
+		return NewRoundRobin(backends...), nil
+	case "leastconn":
+		return NewLeastConn(backends...), nil
+	case "twochoices":
+		return NewTwoChoices(backends...), nil
+	case "hash":
+		return NewConsistentHash(nil, backends...), nil
+	}
+	return nil, fmt.Errorf("Unknown balance %s", r.Balance)
+}
+
+func resolveAddr(kind, address string) (net.Addr, error) {
+	switch kind {
+	case "tcp":
+		return net.ResolveTCPAddr(kind, address)
+	case "udp":
+		return net.ResolveUDPAddr(kind, address)
+	case "unix":
+		return net.ResolveUnixAddr(kind, address)
+	}
+	return nil, fmt.Errorf("Unknown kind %s", kind)
+}
+
+// 是否符合规则
+func (r *SniffRule) Match(info *SniffInfo) bool {
+	if r.SNI != "" && !MatchDomain(r.SNI, info.SNI) {
+		return false
+	}
+	if r.Host != "" && !MatchDomain(r.Host, info.Host) {
+		return false
+	}
+	if r.Prefix != "" && !bytes.HasPrefix(info.Data, []byte(r.Prefix)) {
+		return false
+	}
+	return true
+}
+
+// 域名是否匹配，*.example.com匹配所有子域名，不区分大小写
+func MatchDomain(pattern, name string) bool {
+	if name == "" {
+		return false
+	}
+	pattern, name = strings.ToLower(pattern), strings.ToLower(name)
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(name, pattern[1:])
+	}
+	return pattern == name
+}
+
+// 每个连接只嗅探一次，匹配的规则留给Track和Failover使用
+func (s *Sniffer) match(c *network.Conn) *SniffRule {
+	if rule, ok := s.matched.Load(c); ok {
+		return rule.(*SniffRule)
+	}
+	info := s.Sniff(c)
+	for _, rule := range s.Rules {
+		if rule.Match(info) {
+			if _, loaded := s.matched.LoadOrStore(c, rule); !loaded {
+				go func() {
+					<-c.Done()
+					s.matched.Delete(c)
+				}()
+			}
+			return rule
+		}
+	}
+	return nil
+}
+
+func (s *Sniffer) Dispatch(c *network.Conn) (string, *network.DialPlan) {
+	if rule := s.match(c); rule != nil {
+		return rule.Router.Dispatch(c)
+	}
+	return "", nil
+}
+
+// 把拨号结果转给各规则的路由
+func (s *Sniffer) Feedback(dp *network.DialPlan, err error) {
+	for _, rule := range s.Rules {
+		if fb, ok := rule.Router.(IFeedback); ok {
+			fb.Feedback(dp, err)
+		}
+	}
+}
+
+// 任意一条规则的路由认为可用即可，路由都不能判断时视为可用
+func (s *Sniffer) IsUsable(kind string, dp *network.DialPlan) bool {
+	usable := true
+	for _, rule := range s.Rules {
+		if u, ok := rule.Router.(IUsable); ok {
+			if u.IsUsable(kind, dp) {
+				return true
+			}
+			usable = false
+		}
+	}
+	return usable
+}
+
+// 连接成功的后端由匹配规则的路由计数，多条规则共用一个路由时也只计一次
+func (s *Sniffer) Track(c *network.Conn, dp *network.DialPlan) {
+	if rule := s.match(c); rule != nil {
+		if tr, ok := rule.Router.(ITracker); ok {
+			tr.Track(c, dp)
+		}
+	}
+}
+
+// 最长的前缀，决定至少要读多少字节
+func (s *Sniffer) prefixSize() (size int) {
+	for _, rule := range s.Rules {
+		if len(rule.Prefix) > size {
+			size = len(rule.Prefix)
+		}
+	}
+	return
+}
+
+// 读取首包并解析SNI或Host，数据留在读缓冲中
+func (s *Sniffer) Sniff(c *network.Conn) *SniffInfo {
+	info := new(SniffInfo)
+	reader := c.GetReaderSize(5 + tlsMaxRecord) // 整个ClientHello记录都能放进读缓冲
+	if reader == nil {
+		return info
+	}
+	raw := c.GetRawConn()
+	raw.SetReadDeadline(time.Now().Add(s.Timeout))
+	defer raw.SetReadDeadline(c.GetReadDeadline()) // 恢复原来的读超时
+
+	info.Data = peekAtLeast(reader, 1)
+	if len(info.Data) == 0 {
+		return info
+	}
+	if info.Data[0] == tlsHandshake {
+		info.Data = peekAtLeast(reader, tlsRecordSize(reader))
+		info.SNI = ParseSNI(info.Data)
+	} else if looksLikeHTTP(info.Data) {
+		info.Data = peekHeaders(reader)
+		info.Host = ParseHost(info.Data)
+	}
+	if size := s.prefixSize(); len(info.Data) < size {
+		info.Data = peekAtLeast(reader, size)
+	}
+	return info
+}
+
+// 至少读到n个字节，超时或出错时返回已经读到的，n不能超过读缓冲的长度
+func peekAtLeast(reader *bufio.Reader, n int) []byte {
+	if n > reader.Size() {
+		n = reader.Size()
+	}
+	data, _ := reader.Peek(n)
+	if buffered := reader.Buffered(); buffered > len(data) {
+		data, _ = reader.Peek(buffered)
+	}
+	return data
+}
+
+// 读到HTTP头结束，或读缓冲已满
+func peekHeaders(reader *bufio.Reader) []byte {
+	data := peekAtLeast(reader, 1)
+	for !bytes.Contains(data, []byte("\r\n\r\n")) && len(data) < reader.Size() {
+		more := peekAtLeast(reader, len(data)+1)
+		if len(more) == len(data) {
+			break // 超时或出错
+		}
+		data = more
+	}
+	return data
+}
+
+// 开头是否HTTP/1的请求方法
+func looksLikeHTTP(data []byte) bool {
+	for _, method := range []string{"GET ", "POST ", "PUT ", "HEAD ", "DELETE ",
+		"OPTIONS ", "PATCH ", "CONNECT ", "TRACE "} {
+		n := len(method)
+		if len(data) < n {
+			n = len(data)
+		}
+		if bytes.Equal(data[:n], []byte(method[:n])) {
+			return true
+		}
+	}
+	return false
+}
+
+// 解析HTTP/1请求头中的Host，去掉端口
+func ParseHost(data []byte) string {
+	lines := strings.Split(string(data), "\r\n")
+	for _, line := range lines[1:] {
+		if line == "" {
+			break
+		}
+		i := strings.IndexByte(line, ':')
+		if i < 0 || !strings.EqualFold(strings.TrimSpace(line[:i]), "Host") {
+			continue
+		}
+		host := strings.TrimSpace(line[i+1:])
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		return host
+	}
+	return ""
+}
+
+const (
+	tlsHandshake   = 0x16
+	tlsClientHello = 0x01
+	tlsServerName  = 0x0000
+)
+
+// 一个TLS记录最长的明文，ClientHello只在第一个记录中查找
+const tlsMaxRecord = 16384
+
+// 首个TLS记录的长度，包括5字节的记录头，最长不超过tlsMaxRecord
+func tlsRecordSize(reader *bufio.Reader) int {
+	header := peekAtLeast(reader, 5)
+	if len(header) < 5 {
+		return len(header)
+	}
+	size := int(header[3])<<8 + int(header[4])
+	if size > tlsMaxRecord {
+		size = tlsMaxRecord
+	}
+	return 5 + size
+}
+
+// 按长度前缀切分的字节串
+type tlsReader []byte
+
+func (r *tlsReader) skip(n int) bool {
+	if len(*r) < n {
+		return false
+	}
+	*r = (*r)[n:]
+	return true
+}
+
+func (r *tlsReader) uint(n int) (v int, ok bool) {
+	if len(*r) < n {
+		return 0, false
+	}
+	for _, b := range (*r)[:n] {
+		v = v<<8 | int(b)
+	}
+	*r = (*r)[n:]
+	return v, true
+}
+
+// 读取n字节长度前缀及其后的数据
+func (r *tlsReader) vector(n int) (tlsReader, bool) {
+	size, ok := r.uint(n)
+	if !ok || len(*r) < size {
+		return nil, false
+	}
+	v := (*r)[:size]
+	*r = (*r)[size:]
+	return v, true
+}
+
+// 从TLS ClientHello中解析SNI，数据不完整或没有SNI时返回空串
+func ParseSNI(data []byte) string {
+	r := tlsReader(data)
+	if t, ok := r.uint(1); !ok || t != tlsHandshake {
+		return ""
+	}
+	if !r.skip(4) { // 版本和记录长度
+		return ""
+	}
+	if t, ok := r.uint(1); !ok || t != tlsClientHello {
+		return ""
+	}
+	if !r.skip(3 + 2 + 32) { // 消息长度、版本、随机数
+		return ""
+	}
+	for _, n := range []int{1, 2, 1} { // session id, cipher suites, compression
+		if _, ok := r.vector(n); !ok {
+			return ""
+		}
+	}
+	exts, ok := r.vector(2)
+	for ok && len(exts) > 0 {
+		var (
+			typ  int
+			body tlsReader
+		)
+		if typ, ok = exts.uint(2); !ok {
+			break
+		}
+		if body, ok = exts.vector(2); !ok || typ != tlsServerName {
+			continue
+		}
+		names, ok := body.vector(2)
+		for ok && len(names) > 0 {
+			var (
+				nameType int
+				name     tlsReader
+			)
+			if nameType, ok = names.uint(1); !ok {
+				break
+			}
+			if name, ok = names.vector(2); ok && nameType == 0 {
+				return string(name)
+			}
+		}
+		return ""
+	}
+	return ""
+}
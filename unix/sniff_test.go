@@ -0,0 +1,171 @@
+package unix
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/azhai/gozzo-net/network"
+)
+
+const sniffToml = `
+timeout = 1
+
+[[rule]]
+sni = "*.example.com"
+backends = ["127.0.0.1:8443"]
+
+[[rule]]
+host = "api.example.com"
+backends = ["127.0.0.1:8081", "127.0.0.1:8082"]
+balance = "leastconn"
+
+[[rule]]
+prefix = "SSH-"
+backends = ["127.0.0.1:22"]
+
+[[rule]]
+backends = ["127.0.0.1:8080"]
+`
+
+func loadTestSniffer(t *testing.T) *Sniffer {
+	dir, err := ioutil.TempDir("", "gozzo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "sniff.toml")
+	if err = ioutil.WriteFile(filename, []byte(sniffToml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sniffer, err := LoadSniffer(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sniffer
+}
+
+func TestSniffer(t *testing.T) {
+	sniffer := loadTestSniffer(t)
+	if sniffer.Timeout != time.Second || len(sniffer.Rules) != 4 {
+		t.Fatalf("loaded %d rules with timeout %s", len(sniffer.Rules), sniffer.Timeout)
+	}
+	cases := []struct {
+		name  string
+		send  func(c *tls.Conn, raw func([]byte))
+		ports []string
+	}{
+		{"tls", func(c *tls.Conn, raw func([]byte)) { c.Handshake() }, []string{"8443"}},
+		{"http", func(c *tls.Conn, raw func([]byte)) {
+			raw([]byte("GET / HTTP/1.1\r\nHost: API.example.com:8000\r\nAccept: */*\r\n\r\n"))
+		}, []string{"8081", "8082"}},
+		{"prefix", func(c *tls.Conn, raw func([]byte)) {
+			raw([]byte("SSH-2.0-OpenSSH_8.9\r\n"))
+		}, []string{"22"}},
+		{"default", func(c *tls.Conn, raw func([]byte)) {
+			raw([]byte("hello\n"))
+		}, []string{"8080"}},
+	}
+	for _, cs := range cases {
+		c, client := tcpPair(t)
+		tc := tls.Client(client, &tls.Config{ServerName: "www.example.com"})
+		go cs.send(tc, func(data []byte) { client.Write(data) })
+		kind, dp := sniffer.Dispatch(c)
+		if kind != "tcp" || dp == nil {
+			t.Fatalf("%s: no backend", cs.name)
+		}
+		matched := false
+		for _, port := range cs.ports {
+			if dp.RemoteAddr.String() == "127.0.0.1:"+port {
+				matched = true
+			}
+		}
+		if !matched {
+			t.Fatalf("%s: routed to %s", cs.name, dp.RemoteAddr)
+		}
+		// 嗅探过的数据仍然可以读到
+		first, err := c.GetReader().ReadByte()
+		if err != nil {
+			t.Fatalf("%s: %v", cs.name, err)
+		}
+		if cs.name == "tls" && first != tlsHandshake || cs.name == "prefix" && first != 'S' {
+			t.Fatalf("%s: first byte %q was consumed", cs.name, first)
+		}
+		client.Close()
+		c.Close()
+	}
+}
+
+// 构造ClientHello，SNI扩展之前有padding字节的填充扩展
+func buildClientHello(name string, padding int) []byte {
+	u16 := func(n int) []byte { return []byte{byte(n >> 8), byte(n)} }
+	sni := append(append([]byte{0}, u16(len(name))...), name...) // host_name
+	sni = append(u16(len(sni)), sni...)
+	exts := append(append([]byte{0, 21}, u16(padding)...), make([]byte, padding)...)
+	exts = append(append(append(exts, 0, 0), u16(len(sni))...), sni...)
+	body := append([]byte{3, 3}, make([]byte, 32)...) // 版本和随机数
+	body = append(body, 0)                            // session id
+	body = append(body, 0, 2, 0x13, 0x01, 1, 0)       // cipher suites, compression
+	body = append(append(body, u16(len(exts))...), exts...)
+	hs := append([]byte{tlsClientHello, 0}, u16(len(body))...)
+	hs = append(hs, body...)
+	return append(append([]byte{tlsHandshake, 3, 1}, u16(len(hs))...), hs...)
+}
+
+// ClientHello超过默认的读缓冲时，仍然能找到SNI，数据一个字节也不少
+func TestSniffLargeClientHello(t *testing.T) {
+	sniffer := loadTestSniffer(t)
+	hello := buildClientHello("www.example.com", 6000)
+	c, client := tcpPair(t)
+	defer client.Close()
+	defer c.Close()
+	go client.Write(hello)
+	if info := sniffer.Sniff(c); info.SNI != "www.example.com" {
+		t.Fatalf("got SNI %q from %d bytes", info.SNI, len(info.Data))
+	}
+	data := make([]byte, len(hello))
+	if _, err := io.ReadFull(c.GetReader(), data); err != nil || !bytes.Equal(data, hello) {
+		t.Fatalf("read back %d bytes, %v", len(data), err)
+	}
+}
+
+// Dispatch之后数据已被读走，Track和Failover仍然使用同一条规则，不再等待首包
+func TestSniffOnce(t *testing.T) {
+	sniffer := loadTestSniffer(t)
+	c, client := tcpPair(t)
+	defer client.Close()
+	defer c.Close()
+	client.Write([]byte("GET / HTTP/1.1\r\nHost: api.example.com\r\n\r\n"))
+	_, dp := sniffer.Dispatch(c)
+	if dp == nil {
+		t.Fatal("no backend")
+	}
+	c.GetReader().Discard(c.GetReader().Buffered())
+	start := time.Now()
+	sniffer.Track(c, dp)
+	_, next := sniffer.Failover(c, []*network.DialPlan{dp})
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("sniffed again for %s", elapsed)
+	}
+	if next == nil || next == dp || next.RemoteAddr.String() == "127.0.0.1:8080" {
+		t.Fatalf("failover left the matched rule: %v", next)
+	}
+}
+
+func TestParseHost(t *testing.T) {
+	req := []byte("POST /x HTTP/1.1\r\nUser-Agent: test\r\nhost: [::1]:8080\r\n\r\nbody")
+	if host := ParseHost(req); host != "::1" {
+		t.Fatalf("got host %q", host)
+	}
+	if ParseSNI(req) != "" {
+		t.Fatal("a HTTP request has no SNI")
+	}
+	if !MatchDomain("*.example.com", "a.b.example.com") || MatchDomain("*.example.com", "example.com") {
+		t.Fatal("wildcard domain mismatch")
+	}
+}
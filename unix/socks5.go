@@ -0,0 +1,252 @@
+package unix
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/azhai/gozzo-net/network"
+)
+
+// 前端代理握手的默认超时
+const DefaultHandshakeTimeout = 10 * time.Second
+
+const (
+	socksVersion = 0x05
+	authVersion  = 0x01 // RFC 1929 用户名/密码认证的子协商版本
+
+	authNone         = 0x00
+	authPassword     = 0x02
+	authNoAcceptable = 0xff
+
+	cmdConnect = 0x01
+
+	atypIPv4   = 0x01
+	atypDomain = 0x03
+	atypIPv6   = 0x04
+
+	replySucceeded       = 0x00
+	replyFailure         = 0x01
+	replyNotAllowed      = 0x02
+	replyNetUnreachable  = 0x03
+	replyHostUnreachable = 0x04
+	replyRefused         = 0x05
+	replyCmdNotSupported = 0x07
+	replyAtypNotSupport  = 0x08
+)
+
+var (
+	ErrSocksVersion = fmt.Errorf("Unsupported SOCKS version")
+	ErrSocksAuth    = fmt.Errorf("SOCKS authentication failed")
+	ErrSocksCommand = fmt.Errorf("Unsupported SOCKS command")
+)
+
+// SOCKS5前端（RFC 1928），只支持CONNECT命令
+// Users: 用户名和密码（RFC 1929），为空时不需要认证
+// Policy: 目标的访问策略，为nil时允许所有目标
+// Timeout: 握手的超时，连接后端的超时见Proxy.ConnectTimeout
+type Socks5 struct {
+	Users   map[string]string
+	Policy  *AccessPolicy
+	Timeout time.Duration
+}
+
+func NewSocks5(users map[string]string, policy *AccessPolicy) *Socks5 {
+	return &Socks5{Users: users, Policy: policy, Timeout: DefaultHandshakeTimeout}
+}
+
+// 作为SOCKS5代理，握手得到目标地址后连接，之后的数据由action转发
+func (p *Proxy) CreateSocks5(socks *Socks5, action ProxyAction) network.ProcessFunc {
+	return func(s *network.Server, c *network.Conn) {
+		raw := c.GetRawConn()
+		if socks.Timeout > 0 {
+			raw.SetDeadline(time.Now().Add(socks.Timeout))
+		}
+		addr, err := socks.Handshake(c)
+		if err != nil {
+			return
+		}
+		raw.SetDeadline(time.Time{})
+		client, err := p.connect(c, &Relayer{Kind: "tcp", DialPlan: network.NewDialPlan(addr, nil, 10)}, false)
+		if err != nil {
+			socks.reply(c, socksReplyCode(err), nil)
+			if p.ConnectFailed != nil {
+				p.ConnectFailed(s, c, err)
+			}
+			return
+		}
+		defer client.Close()
+		conn := client.GetConn()
+		if err = socks.reply(c, replySucceeded, conn.GetLocalAddr()); err == nil {
+			action(s, c, conn)
+		}
+	}
+}
+
+// 协商认证方式并读取请求，返回允许访问的目标地址
+// 出错时已经回应了客户端
+func (socks *Socks5) Handshake(c *network.Conn) (*net.TCPAddr, error) {
+	reader := c.GetReader()
+	// 问候：VER NMETHODS METHODS
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(reader, head); err != nil {
+		return nil, err
+	}
+	if head[0] != socksVersion {
+		return nil, ErrSocksVersion
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(reader, methods); err != nil {
+		return nil, err
+	}
+	method := byte(authNone)
+	if len(socks.Users) > 0 {
+		method = authPassword
+	}
+	if bytes.IndexByte(methods, method) < 0 {
+		c.QuickSend([]byte{socksVersion, authNoAcceptable})
+		return nil, ErrSocksAuth
+	}
+	if err := c.QuickSend([]byte{socksVersion, method}); err != nil {
+		return nil, err
+	}
+	if method == authPassword {
+		if err := socks.authenticate(c); err != nil {
+			return nil, err
+		}
+	}
+
+	// 请求：VER CMD RSV ATYP DST.ADDR DST.PORT
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(reader, req); err != nil {
+		return nil, err
+	}
+	if req[0] != socksVersion {
+		return nil, ErrSocksVersion
+	}
+	host, port, err := readSocksAddr(c, req[3])
+	if err != nil {
+		socks.reply(c, replyAtypNotSupport, nil)
+		return nil, err
+	}
+	if req[1] != cmdConnect {
+		socks.reply(c, replyCmdNotSupported, nil)
+		return nil, ErrSocksCommand
+	}
+	addr, err := socks.Policy.Resolve(host, port)
+	if err != nil {
+		socks.reply(c, socksReplyCode(err), nil)
+		return nil, err
+	}
+	return addr, nil
+}
+
+// 用户名/密码认证：VER ULEN UNAME PLEN PASSWD
+func (socks *Socks5) authenticate(c *network.Conn) error {
+	reader := c.GetReader()
+	ver, err := reader.ReadByte()
+	if err != nil {
+		return err
+	}
+	if ver != authVersion {
+		return ErrSocksAuth
+	}
+	user, err := readSocksString(c)
+	if err != nil {
+		return err
+	}
+	pass, err := readSocksString(c)
+	if err != nil {
+		return err
+	}
+	expect, ok := socks.Users[user]
+	if !ok || subtle.ConstantTimeCompare([]byte(expect), []byte(pass)) != 1 {
+		c.QuickSend([]byte{authVersion, 0x01})
+		return ErrSocksAuth
+	}
+	return c.QuickSend([]byte{authVersion, 0x00})
+}
+
+// 回应：VER REP RSV ATYP BND.ADDR BND.PORT
+func (socks *Socks5) reply(c *network.Conn, code byte, bind net.Addr) error {
+	ip, port := net.IPv4zero.To4(), 0
+	if addr, ok := bind.(*net.TCPAddr); ok {
+		ip, port = addr.IP, addr.Port
+	}
+	msg := []byte{socksVersion, code, 0x00}
+	if ip4 := ip.To4(); ip4 != nil {
+		msg = append(append(msg, atypIPv4), ip4...)
+	} else {
+		msg = append(append(msg, atypIPv6), ip.To16()...)
+	}
+	msg = append(msg, byte(port>>8), byte(port))
+	return c.QuickSend(msg)
+}
+
+// 读取一个长度前缀的字符串
+func readSocksString(c *network.Conn) (string, error) {
+	reader := c.GetReader()
+	size, err := reader.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	data := make([]byte, size)
+	if _, err = io.ReadFull(reader, data); err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// 读取目标的地址和端口
+func readSocksAddr(c *network.Conn, atyp byte) (host string, port int, err error) {
+	reader := c.GetReader()
+	switch atyp {
+	case atypIPv4, atypIPv6:
+		size := net.IPv4len
+		if atyp == atypIPv6 {
+			size = net.IPv6len
+		}
+		ip := make([]byte, size)
+		if _, err = io.ReadFull(reader, ip); err != nil {
+			return
+		}
+		host = net.IP(ip).String()
+	case atypDomain:
+		if host, err = readSocksString(c); err != nil {
+			return
+		}
+	default:
+		err = fmt.Errorf("Unsupported address type %d", atyp)
+		return
+	}
+	data := make([]byte, 2)
+	if _, err = io.ReadFull(reader, data); err == nil {
+		port = int(data[0])<<8 | int(data[1])
+	}
+	return
+}
+
+// 按连接失败的原因选择回应码
+func socksReplyCode(err error) byte {
+	err = lastConnectError(err)
+	var dnsErr *net.DNSError
+	switch {
+	case err == ErrForbidden:
+		return replyNotAllowed
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return replyRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return replyNetUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &dnsErr):
+		return replyHostUnreachable
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return replyHostUnreachable
+	}
+	return replyFailure
+}
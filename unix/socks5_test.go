@@ -0,0 +1,147 @@
+package unix
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/azhai/gozzo-net/network"
+)
+
+func runSocks5Proxy(t *testing.T, socks *Socks5) string {
+	addr := deadAddr(t)
+	proxy := NewProxy("tcp", "127.0.0.1", uint16(addr.Port))
+	ready := make(chan bool)
+	events := network.Events{
+		Serving: func(s *network.Server) { ready <- true },
+		Process: proxy.CreateSocks5(socks, RelayData),
+	}
+	go proxy.Run(events)
+	<-ready
+	return addr.String()
+}
+
+// 完成认证并发出CONNECT请求，返回回应码
+func socksConnect(t *testing.T, address, user, pass string, dest *net.TCPAddr) (net.Conn, byte) {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	conn.Write([]byte{socksVersion, 1, authPassword})
+	resp := make([]byte, 2)
+	if _, err = io.ReadFull(conn, resp); err != nil || resp[1] != authPassword {
+		t.Fatalf("method %v, %v", resp, err)
+	}
+	msg := append([]byte{authVersion, byte(len(user))}, user...)
+	msg = append(append(msg, byte(len(pass))), pass...)
+	conn.Write(msg)
+	if _, err = io.ReadFull(conn, resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp[1] != 0 {
+		return conn, authNoAcceptable
+	}
+	req := append([]byte{socksVersion, cmdConnect, 0, atypIPv4}, dest.IP.To4()...)
+	conn.Write(append(req, byte(dest.Port>>8), byte(dest.Port)))
+	reply := make([]byte, 10)
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	return conn, reply[1]
+}
+
+func TestSocks5(t *testing.T) {
+	backend := tcpEchoBackend(t, "127.0.0.1:0")
+	defer backend.Close()
+	dest := backend.Addr().(*net.TCPAddr)
+	policy := &AccessPolicy{Allow: []string{"127.0.0.0/8"}, Deny: []string{"*:25"}}
+	address := runSocks5Proxy(t, NewSocks5(map[string]string{"alice": "secret"}, policy))
+
+	conn, code := socksConnect(t, address, "alice", "secret", dest)
+	if code != replySucceeded {
+		t.Fatalf("reply %d", code)
+	}
+	conn.Write([]byte("hello\n"))
+	if line, err := bufio.NewReader(conn).ReadString('\n'); line != "hello\n" {
+		t.Fatalf("got %q, %v", line, err)
+	}
+	conn.Close()
+
+	conn, code = socksConnect(t, address, "alice", "wrong", dest)
+	conn.Close()
+	if code != authNoAcceptable {
+		t.Fatal("wrong password accepted")
+	}
+	cases := []struct {
+		dest *net.TCPAddr
+		code byte
+	}{
+		{&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 25}, replyNotAllowed},
+		{&net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: dest.Port}, replyNotAllowed},
+		{deadAddr(t), replyRefused},
+	}
+	for _, cs := range cases {
+		conn, code = socksConnect(t, address, "alice", "secret", cs.dest)
+		conn.Close()
+		if code != cs.code {
+			t.Fatalf("%s: reply %d, want %d", cs.dest, code, cs.code)
+		}
+	}
+}
+
+func TestAccessPolicy(t *testing.T) {
+	policy := &AccessPolicy{
+		Allow: []string{"*.example.com:443", "10.0.0.0/8", "::1"},
+		Deny:  []string{"10.1.0.0/16", "bad.example.com"},
+	}
+	local := []net.IP{net.ParseIP("10.2.3.4")}
+	cases := []struct {
+		host   string
+		ips    []net.IP
+		port   int
+		permit bool
+	}{
+		{"www.example.com", local, 443, true},
+		{"www.example.com", local, 80, true}, // 解析到允许的网段
+		{"www.example.com", []net.IP{net.ParseIP("8.8.8.8")}, 80, false},
+		{"bad.example.com", local, 443, false},
+		{"", []net.IP{net.ParseIP("10.1.2.3")}, 22, false},
+		{"", []net.IP{net.ParseIP("::1")}, 22, true},
+		{"www.example.com", []net.IP{net.ParseIP("10.2.3.4"), net.ParseIP("10.1.2.3")}, 443, false},
+	}
+	for _, cs := range cases {
+		if policy.Permit(cs.host, cs.ips, cs.port) != cs.permit {
+			t.Fatalf("%s %v:%d should be %v", cs.host, cs.ips, cs.port, cs.permit)
+		}
+	}
+	if !(*AccessPolicy)(nil).Permit("any", nil, 1) {
+		t.Fatal("nil policy should permit all")
+	}
+}
+
+// 域名同时解析到允许的地址和内部地址，只能连接允许的地址
+func TestAccessPolicyMixed(t *testing.T) {
+	allowed, internal := net.ParseIP("203.0.113.7"), net.ParseIP("192.168.1.1")
+	defer func(orig func(string) ([]net.IP, error)) { lookupIP = orig }(lookupIP)
+	lookupIP = func(host string) ([]net.IP, error) {
+		return []net.IP{internal, allowed}, nil
+	}
+	policy := &AccessPolicy{Allow: []string{"203.0.113.0/24"}}
+	if policy.Permit("mixed.example.com", []net.IP{internal, allowed}, 80) {
+		t.Fatal("mixed addresses should not be permitted")
+	}
+	if addr, err := policy.Resolve("mixed.example.com", 80); err != nil || !addr.IP.Equal(allowed) {
+		t.Fatalf("resolved to %v, %v", addr, err)
+	}
+	policy = &AccessPolicy{Deny: []string{"192.168.0.0/16"}}
+	if addr, err := policy.Resolve("mixed.example.com", 80); err != nil || !addr.IP.Equal(allowed) {
+		t.Fatalf("resolved to %v, %v", addr, err)
+	}
+	policy = &AccessPolicy{Allow: []string{"198.51.100.0/24"}}
+	if _, err := policy.Resolve("mixed.example.com", 80); err != ErrForbidden {
+		t.Fatalf("got %v", err)
+	}
+}
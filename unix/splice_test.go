@@ -0,0 +1,100 @@
+// +build linux
+
+package unix
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSplicePeeked(t *testing.T) {
+	orig, client := tcpPair(t)
+	defer client.Close()
+	relay, backend := tcpPair(t)
+	defer backend.Close()
+	client.Write([]byte("hello "))
+	if _, err := orig.Peek(6); err != nil { // 模拟嗅探，数据留在读缓冲中
+		t.Fatal(err)
+	}
+	results := make(chan *RelayResult, 1)
+	go func() {
+		opts := DefaultRelayOptions
+		opts.Splice = true
+		results <- Relay(orig, relay, opts)
+	}()
+	payload := bytes.Repeat([]byte("0123456789abcdef"), 1<<16)
+	client.Write(payload)
+	client.(*net.TCPConn).CloseWrite()
+
+	backend.SetDeadline(time.Now().Add(3 * time.Second))
+	data, err := ioutil.ReadAll(backend)
+	if err != nil || !bytes.HasPrefix(data, []byte("hello 0123")) || len(data) != 6+len(payload) {
+		t.Fatalf("backend got %d bytes, %v", len(data), err)
+	}
+	backend.Write([]byte("bye"))
+	backend.(*net.TCPConn).CloseWrite()
+	client.SetDeadline(time.Now().Add(3 * time.Second))
+	if reply, err := ioutil.ReadAll(client); err != nil || string(reply) != "bye" {
+		t.Fatalf("client got %q, %v", reply, err)
+	}
+	result := <-results
+	if result.Upstream != int64(len(data)) || result.Downstream != 3 || result.FirstClosed != "client" {
+		t.Fatalf("result %s", result)
+	}
+}
+
+// 进程消耗的CPU时间，用户态加内核态
+func cpuTime() time.Duration {
+	var usage syscall.Rusage
+	syscall.Getrusage(syscall.RUSAGE_SELF, &usage)
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
+
+// 客户端经过转发向后端写入b.N块数据，报告每块消耗的CPU时间
+func benchmarkRelay(b *testing.B, opts RelayOptions) {
+	orig, client := tcpPair(b)
+	defer client.Close()
+	relay, backend := tcpPair(b)
+	defer backend.Close()
+	done := make(chan struct{})
+	go func() {
+		Relay(orig, relay, opts)
+		close(done)
+	}()
+	drained := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, backend)
+		backend.(*net.TCPConn).CloseWrite()
+		close(drained)
+	}()
+
+	chunk := make([]byte, 64*1024)
+	b.SetBytes(int64(len(chunk)))
+	b.ResetTimer()
+	start := cpuTime()
+	for i := 0; i < b.N; i++ {
+		if _, err := client.Write(chunk); err != nil {
+			b.Fatal(err)
+		}
+	}
+	client.(*net.TCPConn).CloseWrite()
+	<-drained
+	b.StopTimer()
+	b.ReportMetric(float64(cpuTime()-start)/float64(b.N), "cpu-ns/op")
+	<-done
+}
+
+func BenchmarkRelayCopy(b *testing.B) {
+	benchmarkRelay(b, DefaultRelayOptions)
+}
+
+func BenchmarkRelaySplice(b *testing.B) {
+	opts := DefaultRelayOptions
+	opts.Splice = true
+	benchmarkRelay(b, opts)
+}